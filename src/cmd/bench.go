@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/docker"
+	"github.com/brenozd/tc-docker/internal/instance"
+	"github.com/brenozd/tc-docker/internal/tc"
+	"github.com/brenozd/tc-docker/pkg/command"
+	"github.com/spf13/cobra"
+)
+
+var (
+	benchContainers  int
+	benchConcurrency int
+	benchRate        string
+	benchDelay       string
+)
+
+func init() {
+	benchCmd.Flags().IntVarP(&benchContainers, "containers", "n", 100, "synthetic containers to shape")
+	benchCmd.Flags().IntVar(&benchConcurrency, "concurrency", 8, "containers shaped at once, like --workers of the daemon")
+	benchCmd.Flags().StringVar(&benchRate, "rate", "100mbit", "upload and download rate of every container")
+	benchCmd.Flags().StringVar(&benchDelay, "delay", "0ms", "latency delay of every container")
+	rootCmd.AddCommand(benchCmd)
+}
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Measure how long shaping N synthetic containers takes on this host",
+	Long: "Creates N veth pairs and ifbs on the host, shapes them like containers with the given limits\n" +
+		"using --concurrency workers, prints the apply latency and removes everything.\n" +
+		"Docker discovery is not measured. It needs the same privileges as the daemon.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if benchContainers < 1 || benchConcurrency < 1 {
+			return fmt.Errorf("containers and concurrency must be positive")
+		}
+		if err := global.LoadConfig(""); err != nil {
+			return err
+		}
+		// The synthetic containers are shaped like the daemon does, so it must not run meanwhile
+		lock, err := instance.Acquire(instance.OnConflictExit, global.Conf.StateDir)
+		if err != nil {
+			return fmt.Errorf("bench cannot run along the daemon, %v", err)
+		}
+		defer lock.Release()
+		// The qdiscs of the synthetic containers are recorded in a throwaway state directory,
+		// not the one of the daemon
+		stateDir, err := ioutil.TempDir("", "tc-docker-bench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(stateDir)
+		global.Conf.StateDir = stateDir
+
+		var containers []*docker.Container
+		defer func() {
+			for _, container := range containers {
+				tc.Release(container.ID)
+				command.CombinedOutput("/usr/sbin/ip link del " + container.Veth)
+				command.CombinedOutput("/usr/sbin/ip link del " + container.Ifb)
+			}
+		}()
+		for i := 0; i < benchContainers; i++ {
+			container := &docker.Container{
+				ID:           fmt.Sprintf("bench%07d", i),
+				Name:         fmt.Sprintf("tc-docker-bench-%d", i),
+				Veth:         fmt.Sprintf("vethb%05d", i),
+				Ifb:          fmt.Sprintf("ifbb%05d", i),
+				UploadRate:   benchRate,
+				UploadCeil:   benchRate,
+				DownloadRate: benchRate,
+				DownloadCeil: benchRate,
+				LatencyDelay: benchDelay,
+			}
+			for _, c := range []string{
+				fmt.Sprintf("/usr/sbin/ip link add %s type veth peer name vethp%05d", container.Veth, i),
+				fmt.Sprintf("/usr/sbin/ip link set %s up", container.Veth),
+				fmt.Sprintf("/usr/sbin/ip link add %s type ifb", container.Ifb),
+				fmt.Sprintf("/usr/sbin/ip link set %s up", container.Ifb),
+			} {
+				if out, err := command.CombinedOutput(c); err != nil {
+					return fmt.Errorf("cmd: %s, out: %s, error: %v", c, out, err)
+				}
+			}
+			containers = append(containers, container)
+		}
+
+		latencies := make([]time.Duration, len(containers))
+		errs := make([]error, len(containers))
+		sem := make(chan struct{}, benchConcurrency)
+		var wg sync.WaitGroup
+		start := time.Now()
+		for i, container := range containers {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, container docker.Container) {
+				defer func() { <-sem; wg.Done() }()
+				applyStart := time.Now()
+				errs[i] = tc.SetTC(&container)
+				latencies[i] = time.Since(applyStart)
+			}(i, *container)
+		}
+		wg.Wait()
+		total := time.Since(start)
+
+		failed := 0
+		for i, err := range errs {
+			if err != nil {
+				failed++
+				if failed == 1 {
+					fmt.Printf("first failure, container: %s, error: %v\n", containers[i].Name, err)
+				}
+			}
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		percentile := func(p float64) time.Duration {
+			return latencies[int(p*float64(len(latencies)-1))]
+		}
+		fmt.Printf("containers: %d, concurrency: %d, failed: %d\n", len(containers), benchConcurrency, failed)
+		fmt.Printf("total: %v, throughput: %.1f containers/s\n", total, float64(len(containers))/total.Seconds())
+		fmt.Printf("apply latency p50: %v, p90: %v, p99: %v, max: %v\n", percentile(0.5), percentile(0.9), percentile(0.99), latencies[len(latencies)-1])
+		return nil
+	},
+}
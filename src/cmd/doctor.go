@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/preflight"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that the host provides what shaping needs and tell how to fix what it lacks",
+	Long: "Checks the privileges, iproute2, the kernel features, by shaping a scratch ifb, the cgroup version,\n" +
+		"the Docker API and the netns mount the way the daemon does on startup. It needs the same privileges\n" +
+		"and mounts as the daemon and exits with an error when shaping cannot work.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		results := preflight.Run(global.Ctx, global.DockerClient)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", status(r), r.Name, r.Detail)
+			if !r.OK && r.Fix != "" {
+				fmt.Fprintf(w, "\t\tfix: %s\n", r.Fix)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if broken := preflight.Broken(results); len(broken) > 0 {
+			return fmt.Errorf("%d required checks failed, containers cannot be shaped", len(broken))
+		}
+		return nil
+	},
+}
+
+func status(r preflight.Result) string {
+	switch {
+	case r.OK:
+		return "ok"
+	case r.Required:
+		return "FAIL"
+	}
+	return "warn"
+}
+
+// checkHost runs the checks of doctor on startup, the daemon refuses to start when a required one fails
+func checkHost() {
+	results := preflight.Run(global.Ctx, global.DockerClient)
+	for _, r := range results {
+		switch {
+		case r.OK:
+			glog.Debugf("Preflight %s ok, %s", r.Name, r.Detail)
+		case r.Required:
+			glog.Errorf("Preflight %s failed, %s, fix: %s", r.Name, r.Detail, r.Fix)
+		default:
+			glog.Warnf("Preflight %s failed, %s, fix: %s", r.Name, r.Detail, r.Fix)
+		}
+	}
+	if broken := preflight.Broken(results); len(broken) > 0 {
+		glog.Fatalf("%d required preflight checks failed, containers cannot be shaped, fix the errors above or start with --skip-preflight", len(broken))
+	}
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/brenozd/tc-docker/pkg/distribution"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(maketableCmd)
+}
+
+var maketableCmd = &cobra.Command{
+	Use:   "maketable <samples file>",
+	Short: "Print the netem distribution table of a file of latency samples",
+	Long: "Print the netem distribution table of a file of whitespace separated latency samples, " +
+		"the same table iproute2 maketable generates. The daemon generates tables of the distributions in its config on startup.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		samples, err := distribution.ReadSamples(f)
+		if err != nil {
+			return err
+		}
+		table, err := distribution.Make(samples)
+		if err != nil {
+			return err
+		}
+		return table.Write(os.Stdout)
+	},
+}
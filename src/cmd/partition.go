@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	"github.com/brenozd/tc-docker/internal/api"
+	"github.com/brenozd/tc-docker/internal/tc"
+	"github.com/spf13/cobra"
+)
+
+var partitionDirection string
+
+func init() {
+	partitionAddCmd.Flags().StringVar(&partitionDirection, "direction", tc.PartitionBoth, "both, egress (container cannot send to peer) or ingress (container cannot receive from peer)")
+	partitionCmd.AddCommand(partitionAddCmd, partitionHealCmd, partitionListCmd)
+	rootCmd.AddCommand(partitionCmd)
+}
+
+// handlePartitions serves the partitions of the running daemon
+func handlePartitions(r *http.Request) (interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+		return tc.ListPartitions(), nil
+	case http.MethodPost:
+		var p tc.Partition
+		if err := api.Decode(r, &p); err != nil {
+			return nil, err
+		}
+		return nil, tc.AddPartition(p)
+	case http.MethodDelete:
+		var p tc.Partition
+		if err := api.Decode(r, &p); err != nil {
+			return nil, err
+		}
+		return nil, tc.HealPartition(p.Container, p.Peer)
+	}
+	return nil, fmt.Errorf("method %s not allowed", r.Method)
+}
+
+var partitionCmd = &cobra.Command{
+	Use:   "partition",
+	Short: "Cut and heal traffic between containers and peers on the running daemon",
+}
+
+var partitionAddCmd = &cobra.Command{
+	Use:   "add <container> <peer>...",
+	Short: "Drop traffic between a container and peers, either CIDRs, IPs or container names",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, peer := range args[1:] {
+			p := tc.Partition{Container: args[0], Peer: peer, Direction: partitionDirection}
+			if err := api.Call(socket, http.MethodPost, "/partitions", p, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var partitionHealCmd = &cobra.Command{
+	Use:   "heal <container> [peer]",
+	Short: "Remove the partition between a container and a peer, or all partitions of the container",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		p := tc.Partition{Container: args[0]}
+		if len(args) > 1 {
+			p.Peer = args[1]
+		}
+		return api.Call(socket, http.MethodDelete, "/partitions", p, nil)
+	},
+}
+
+var partitionListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List partitions",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var list []tc.Partition
+		if err := api.Call(socket, http.MethodGet, "/partitions", nil, &list); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CONTAINER\tPEER\tDIRECTION\tSOURCE")
+		for _, p := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Container, p.Peer, p.Direction, p.Source)
+		}
+		return w.Flush()
+	},
+}
@@ -2,44 +2,122 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/CodyGuo/glog"
 	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/api"
 	"github.com/brenozd/tc-docker/internal/docker"
+	"github.com/brenozd/tc-docker/internal/instance"
+	"github.com/brenozd/tc-docker/internal/metrics"
 	"github.com/brenozd/tc-docker/internal/tc"
 	"github.com/spf13/cobra"
 )
 
-var debug bool
+var (
+	debug       bool
+	configFile  string
+	socket      string
+	metricsAddr string
+	workers     int
+	onConflict  string
+	noPreflight bool
+)
 
 func init() {
 	rootCmd.Flags().BoolVarP(&debug, "debug", "d", false, "set logger debug")
+	rootCmd.Flags().StringVarP(&configFile, "config", "c", "", "daemon config file")
+	rootCmd.Flags().IntVar(&workers, "workers", 8, "docker events handled at once, events of a container are always handled in order")
+	rootCmd.Flags().StringVar(&metricsAddr, "metrics", "", "address to expose Prometheus metrics on, e.g. :9110")
+	rootCmd.Flags().StringVar(&onConflict, "on-conflict", instance.OnConflictExit, "when another daemon runs on the host: exit, wait for it to exit or takeover from it")
+	rootCmd.Flags().BoolVar(&noPreflight, "skip-preflight", false, "start even when the host lacks what shaping needs, see doctor")
+	rootCmd.PersistentFlags().StringVar(&socket, "socket", api.Socket, "daemon control socket")
 }
 
 var rootCmd = &cobra.Command{
-	Use:   "",
+	Use:   "tc-docker",
 	Short: "",
 	Long:  "",
 	PreRun: func(cmd *cobra.Command, args []string) {
 		if debug {
 			glog.SetLevel(glog.DEBUG)
 		}
+		if err := global.LoadConfig(configFile); err != nil {
+			glog.Fatal(err)
+		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		c := docker.NewContainer(global.Ctx, global.DockerClient)
-		containers, err := c.GetRunningList()
+		lock, err := instance.Acquire(onConflict, global.Conf.StateDir)
+		if _, ok := err.(*instance.HeldError); ok {
+			glog.Fatalf("%v, stop it or start with --on-conflict %s or %s", err, instance.OnConflictWait, instance.OnConflictTakeover)
+		}
 		if err != nil {
 			glog.Fatal(err)
 		}
-		for _, container := range containers {
-			err := tc.SetTC(container)
-			if err != nil {
-				glog.Errorf("SetTC failed, container: %s, id: %s, error: %v", container.Name, container.ID, err)
-				continue
+		// A takeover is served from now on, even while starting up, so the new instance doesn't time out.
+		// The daemon stops once global.Ctx is cancelled.
+		go func() {
+			<-lock.Handoff()
+			glog.Infof("Another instance takes over, stopping and leaving the shaping in place")
+			global.Cancel()
+		}()
+		if !noPreflight {
+			checkHost()
+		}
+
+		if err := tc.GenerateDistributions(); err != nil {
+			glog.Fatal(err)
+		}
+
+		c := docker.NewContainer(global.Ctx, global.DockerClient, workers)
+		tc.ResolvePeer = c.GetIPs
+
+		if err := tc.LoadQuotas(); err != nil {
+			glog.Fatal(err)
+		}
+		if err := tc.LoadQdiscs(); err != nil {
+			glog.Fatal(err)
+		}
+
+		api.Handle("/partitions", handlePartitions)
+		api.Handle("/status", handleStatus)
+		go func() {
+			if err := api.Serve(socket); err != nil {
+				glog.Errorf("Control socket %s failed, error: %v", socket, err)
 			}
-			glog.Infof("SetTC success, %s", tc.GetTcString(container))
+		}()
+		if metricsAddr != "" {
+			metrics.Register(tc.Metrics)
+			metrics.Register(c.EventMetrics)
+			go func() {
+				if err := metrics.Serve(metricsAddr); err != nil {
+					glog.Errorf("Metrics listener %s failed, error: %v", metricsAddr, err)
+				}
+			}()
+		}
+		// watchers return once global.Ctx is cancelled
+		var watchers sync.WaitGroup
+		for _, watch := range []func(){
+			func() { tc.WatchReference(30 * time.Second) },
+			tc.WatchSchedules,
+			func() { tc.WatchQuotas(10 * time.Second) },
+			func() { tc.WatchCredits(5 * time.Second) },
+			func() { watchLinks(c) },
+		} {
+			watchers.Add(1)
+			go func(watch func()) {
+				defer watchers.Done()
+				watch()
+			}(watch)
 		}
 
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 		startErr := c.EventStart(func(container docker.Container) error {
 			err := tc.SetTC(&container)
 			if err != nil {
@@ -50,20 +128,153 @@ var rootCmd = &cobra.Command{
 		})
 		dieErr := c.EventDie(func(container docker.Container) error {
 			glog.Infof("Container stopped, name: %s, id: %s", container.Name, container.ID)
-			c.RemoveIfb(container.Name)
-			return c.RemoveVeth(container.Name)
+			if owner, remaining, ok := tc.LeaveNetns(container.ID); ok {
+				if remaining > 0 {
+					glog.Infof("Network namespace still in use, owner: %s, members left: %d", owner.Name, remaining)
+					reshape(c, owner)
+					return nil
+				}
+				container = owner
+			}
+			return release(c, container)
+		})
+		c.EventResync(func() {
+			if err := scan(c); err != nil {
+				glog.Errorf("Resync failed, error: %v", err)
+			}
 		})
+		// The containers found are shaped by the handlers, which must be in place first
+		if err := scan(c); err != nil && global.Ctx.Err() == nil {
+			glog.Fatal(err)
+		}
 		for {
 			select {
 			case err := <-startErr:
 				glog.Errorf("EventStart error: %v", err)
+				if failure, ok := err.(*docker.StartError); ok {
+					tc.RecordFailure(failure.ID, failure.Name, failure.Err)
+				}
 			case err := <-dieErr:
 				glog.Errorf("EventDie error: %v", err)
+			case <-global.Ctx.Done():
+				// Nothing may change the host once the new instance holds the lock
+				stop(c, &watchers)
+				lock.Release()
+				return
+			case sig := <-signals:
+				glog.Infof("Stopping on %v, leaving the shaping of containers in place", sig)
+				stop(c, &watchers)
+				if err := tc.ReleaseUplink(); err != nil {
+					glog.Errorf("Restoring the uplink root qdisc failed, error: %v", err)
+				}
+				lock.Release()
+				return
 			}
 		}
 	},
 }
 
+// stop stops handling events and the watchers and saves the quota usage, nothing changes the host afterwards
+func stop(c *docker.Container, watchers *sync.WaitGroup) {
+	global.Cancel()
+	c.Stop()
+	watchers.Wait()
+	if err := tc.SaveQuotas(); err != nil {
+		glog.Errorf("Saving quota usage failed, error: %v", err)
+	}
+}
+
+// scan queues shaping the running containers that are not shaped yet, behind their pending events like
+// a start, and releases the managed ones that are gone or whose veth changed. It runs on startup and
+// when docker events were missed.
+func scan(c *docker.Container) error {
+	start := time.Now()
+	containers, failures, err := c.GetRunningList()
+	if err != nil {
+		return err
+	}
+	// The daemon is stopping, e.g. handing over to another instance
+	if err := global.Ctx.Err(); err != nil {
+		return err
+	}
+	tc.AdoptQdiscs(containers)
+	// running holds the members of the network namespace of each discovered veth
+	running := make(map[string]string)
+	for _, container := range containers {
+		running[container.ID+"/"+container.Veth] = strings.Join(container.Members, ",")
+	}
+	// Containers that could not be discovered are retried, their current shaping is kept meanwhile
+	undiscovered := make(map[string]bool)
+	queued := make(map[string]bool)
+	for _, failure := range failures {
+		undiscovered[failure.ID] = true
+		glog.Errorf("Discovery failed, %v, retrying", failure)
+		queued[failure.ID] = true
+		restart(c, failure.ID, failure.Name)
+	}
+	managed := make(map[string]bool)
+	for _, container := range tc.Managed() {
+		if members, ok := running[container.ID+"/"+container.Veth]; ok {
+			// A shared network namespace is shaped again when its members changed
+			if members == strings.Join(container.Members, ",") {
+				managed[container.ID+"/"+container.Veth] = true
+			}
+			continue
+		}
+		if undiscovered[container.ID] {
+			continue
+		}
+		glog.Infof("Container gone, name: %s, id: %s, veth: %s", container.Name, container.ID, container.Veth)
+		if err := release(c, container); err != nil {
+			glog.Errorf("Release failed, container: %s, id: %s, error: %v", container.Name, container.ID, err)
+		}
+	}
+
+	// Every veth of a container is shaped by the same handler
+	for _, container := range containers {
+		if managed[container.ID+"/"+container.Veth] || queued[container.ID] {
+			continue
+		}
+		queued[container.ID] = true
+		restart(c, container.ID, container.Name)
+	}
+	glog.Infof("Scan done, containers: %d, queued: %d, duration: %v", len(containers)+len(failures), len(queued), time.Since(start))
+	return nil
+}
+
+// release removes a container from the shared trees and deletes what was created for it
+func release(c *docker.Container, container docker.Container) error {
+	if err := tc.Release(container.ID); err != nil {
+		glog.Errorf("Release failed, container: %s, id: %s, error: %v", container.Name, container.ID, err)
+	}
+	c.RemoveIfb(container.Name)
+	return nil
+}
+
+// reshape shapes a shared network namespace again with the labels of its remaining members,
+// the current shaping is kept when it cannot, e.g. the owner of the namespace died
+func reshape(c *docker.Container, owner docker.Container) {
+	containers, err := c.Discover(owner.ID)
+	if err != nil {
+		glog.Warnf("Network namespace not shaped again, owner: %s, error: %v", owner.Name, err)
+		return
+	}
+	for _, container := range containers {
+		if err := tc.SetTC(container); err != nil {
+			glog.Errorf("SetTC failed, container: %s, id: %s, error: %v", container.Name, container.ID, err)
+			continue
+		}
+		glog.Infof("SetTC success, %s", tc.GetTcString(container))
+	}
+}
+
+// restart queues shaping a container found running by a scan, as its start would
+func restart(c *docker.Container, id, name string) {
+	// The scan found it running, it may have started again after a die whose start was missed
+	c.ReviveRetry(id)
+	c.Restore(id, name)
+}
+
 func Execute() error {
 	return rootCmd.Execute()
 }
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/brenozd/tc-docker/internal/api"
+	"github.com/brenozd/tc-docker/internal/tc"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
+
+// handleStatus serves the limits in force on every managed container
+func handleStatus(r *http.Request) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("method %s not allowed", r.Method)
+	}
+	return tc.Status(), nil
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the limits in force on the containers shaped by the running daemon",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var list []tc.ContainerStatus
+		if err := api.Call(socket, http.MethodGet, "/status", nil, &list); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CONTAINER\tVETH\tUPLOAD\tDOWNLOAD\tUPLOAD QUOTA\tDOWNLOAD QUOTA\tUPLOAD CREDITS\tDOWNLOAD CREDITS\tPRIORITY")
+		prioritized := false
+		for _, s := range list {
+			if s.Error != "" {
+				fmt.Fprintf(w, "%s\t-\tfailed: %s\n", s.Name, s.Error)
+				continue
+			}
+			uploadQuota, downloadQuota := "-", "-"
+			if s.Quota != nil {
+				uploadQuota = formatQuota(s.Quota.Upload, s.Quota.UploadQuota, s.Quota.UploadThrottled)
+				downloadQuota = formatQuota(s.Quota.Download, s.Quota.DownloadQuota, s.Quota.DownloadThrottled)
+			}
+			uploadCredits, downloadCredits := "-", "-"
+			if s.Credits != nil {
+				uploadCredits = formatCredits(s.Credits.Upload, s.Credits.UploadMax, s.Credits.UploadExhausted)
+				downloadCredits = formatCredits(s.Credits.Download, s.Credits.DownloadMax, s.Credits.DownloadExhausted)
+			}
+			// Shared network namespaces are shown as their owner
+			name := s.Name
+			if len(s.Members) > 1 {
+				name += fmt.Sprintf(" (%d members)", len(s.Members))
+			}
+			priority := "-"
+			if len(s.Bridges) > 0 {
+				priority = fmt.Sprintf("%s/%s on %s*", s.Priority, s.Weight, strings.Join(s.Bridges, ","))
+				prioritized = true
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s/%s\t%s/%s\t%s\t%s\t%s\t%s\t%s\n", name, s.Veth,
+				s.UploadRate, s.UploadCeil, s.DownloadRate, s.DownloadCeil, uploadQuota, downloadQuota, uploadCredits, downloadCredits, priority)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if prioritized {
+			fmt.Println("* priority/weight apply to traffic crossing the bridge device, not to traffic between containers of the bridge")
+		}
+		return nil
+	},
+}
+
+// formatQuota returns the used and allowed bytes of a quota, marked when throttled
+func formatQuota(used, quota uint64, throttled bool) string {
+	if quota == 0 {
+		return "-"
+	}
+	s := fmt.Sprintf("%s/%s", formatBytes(used), formatBytes(quota))
+	if throttled {
+		s += " (throttled)"
+	}
+	return s
+}
+
+// formatCredits returns the credit balance and its maximum, marked when exhausted
+func formatCredits(balance, max uint64, exhausted bool) string {
+	if max == 0 {
+		return "-"
+	}
+	s := fmt.Sprintf("%s/%s", formatBytes(balance), formatBytes(max))
+	if exhausted {
+		s += " (baseline)"
+	}
+	return s
+}
+
+func formatBytes(b uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	v := float64(b)
+	i := 0
+	for v >= 1000 && i < len(units)-1 {
+		v /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", v, units[i])
+}
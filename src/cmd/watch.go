@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/docker"
+	"github.com/brenozd/tc-docker/internal/tc"
+	"github.com/brenozd/tc-docker/pkg/netlink"
+)
+
+// linkSettle is how long link and qdisc changes must stop before the containers they touched are checked
+const linkSettle = 2 * time.Second
+
+// netnsCheck is how often the containers shaped inside their own network namespace are checked,
+// the changes there are not seen from the host
+const netnsCheck = 30 * time.Second
+
+// touchedNetns marks every container shaped inside its own network namespace as touched
+const touchedNetns = "netns"
+
+// watchLinks follows the links and qdiscs of the host and shapes again the containers whose veth or ifb
+// was recreated or lost a qdisc of tc-docker. Changes are gathered until they settle and the containers
+// are only shaped again when their qdiscs are really gone, so the changes made by tc-docker itself are
+// harmless. Containers shaped inside their own network namespace are checked every netnsCheck instead,
+// the ones shaped on the uplink are not followed.
+func watchLinks(c *docker.Container) {
+	changes := make(chan string, 256)
+	stopped := make(chan struct{})
+	defer func() { <-stopped }()
+	go func() {
+		defer close(stopped)
+		err := netlink.Watch(global.Ctx.Done(), func(e netlink.Event) {
+			dev := e.Name
+			if e.Lost {
+				// Changes were dropped, every container is checked
+				dev = "*"
+			} else if e.Type == syscall.RTM_NEWQDISC || e.Type == syscall.RTM_DELQDISC {
+				if e.Parent != netlink.ParentRoot && e.Parent != netlink.ParentIngress {
+					return
+				}
+				iface, err := net.InterfaceByIndex(e.Index)
+				if err != nil {
+					return
+				}
+				dev = iface.Name
+			}
+			select {
+			case changes <- dev:
+			default:
+				glog.Warnf("Link changes queue full, dropping change of %s", dev)
+			}
+		})
+		if err != nil {
+			glog.Errorf("Watching links stopped, shaping lost by a recreated veth or ifb is not restored, error: %v", err)
+		}
+	}()
+
+	touched := make(map[string]bool)
+	var settle <-chan time.Time
+	ticker := time.NewTicker(netnsCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-global.Ctx.Done():
+			return
+		case <-ticker.C:
+			restore(c, map[string]bool{touchedNetns: true})
+		case dev := <-changes:
+			touched[dev] = true
+			settle = time.After(linkSettle)
+		case <-settle:
+			restore(c, touched)
+			touched = make(map[string]bool)
+			settle = nil
+		}
+	}
+}
+
+// restore queues shaping again the managed containers whose veth or ifb is in touched and lost its
+// qdiscs, behind their pending events. A veth gone means the container stopped or was reconnected to
+// its network, a scan queued once the others are sorts both out.
+func restore(c *docker.Container, touched map[string]bool) {
+	gone := false
+	for _, container := range tc.Managed() {
+		if container.Cgroup != "" {
+			continue
+		}
+		if container.Netns != "" {
+			if !touched["*"] && !touched[touchedNetns] {
+				continue
+			}
+		} else if !touched["*"] && !touched[container.Veth] && !touched[container.Ifb] {
+			continue
+		}
+		if !tc.Present(container) {
+			glog.Infof("Veth gone, container: %s, veth: %s", container.Name, container.Veth)
+			gone = true
+			continue
+		}
+		if !tc.Intact(container) {
+			glog.Infof("Shaping lost, container: %s, veth: %s, ifb: %s, shaping again", container.Name, container.Veth, container.Ifb)
+			c.Restore(container.ID, container.Name)
+		}
+	}
+	if gone {
+		glog.Infof("Veths gone, scanning")
+		c.Resync()
+	}
+}
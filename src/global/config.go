@@ -0,0 +1,154 @@
+package global
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Config holds the daemon configuration loaded from the file given by --config
+type Config struct {
+	Pools map[string]Pool `json:"pools"`
+	// Bridges holds the capacity of docker bridges used to prioritize containers, keyed by device name
+	Bridges map[string]Limit `json:"bridges"`
+	// Reference is the bandwidth percentage rates are relative to
+	Reference Reference `json:"reference"`
+	// Distributions maps a delay distribution name to a file of latency samples in milliseconds
+	Distributions map[string]string `json:"distributions"`
+	// DistributionDir is where generated distribution tables are stored, it must be the directory
+	// tc reads them from. Defaults to $TC_LIB_DIR or /usr/lib/tc
+	DistributionDir string `json:"distributionDir"`
+	// TopologyFile is the path of the latency topology between regions
+	TopologyFile string   `json:"topology"`
+	Topology     Topology `json:"-"`
+	// Schedules maps a schedule name to its windows, see org.label-schema.tc.schedule
+	Schedules map[string][]string `json:"schedules"`
+	// Uplink is the host interface the traffic of host network containers is shaped on.
+	// Defaults to the interface of the default route
+	Uplink string `json:"uplink"`
+	// ForeignQdiscs is what happens to qdiscs tc-docker didn't create where it has to shape,
+	// either refuse, the default, or force to replace them
+	ForeignQdiscs string `json:"foreignQdiscs"`
+	// StateDir is where state that must survive restarts, e.g. quota usage, is kept.
+	// Defaults to /var/lib/tc-docker
+	StateDir string `json:"stateDir"`
+}
+
+const (
+	ForeignQdiscsRefuse = "refuse"
+	ForeignQdiscsForce  = "force"
+)
+
+// Topology describes the links between regions, see org.label-schema.tc.region
+type Topology struct {
+	// Links maps a region to the link towards each other region. A link missing in one
+	// direction is the same as the opposite one.
+	Links map[string]map[string]TopologyLink `json:"links"`
+}
+
+// TopologyLink holds the one-way properties of the path between two regions
+type TopologyLink struct {
+	Latency   string `json:"latency"`
+	Jitter    string `json:"jitter"`
+	Loss      string `json:"loss"`
+	Bandwidth string `json:"bandwidth"`
+}
+
+// Link returns the link packets take from one region to another
+func (t Topology) Link(from, to string) (TopologyLink, bool) {
+	if link, ok := t.Links[from][to]; ok {
+		return link, true
+	}
+	link, ok := t.Links[to][from]
+	return link, ok
+}
+
+// Regions returns every region of the topology, sorted
+func (t Topology) Regions() []string {
+	set := make(map[string]bool)
+	for from, links := range t.Links {
+		set[from] = true
+		for to := range links {
+			set[to] = true
+		}
+	}
+	var regions []string
+	for region := range set {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// Reference is either a fixed host budget or the interface whose speed is used,
+// when both are empty the interface of the default route is used
+type Reference struct {
+	Interface string `json:"interface"`
+	Rate      string `json:"rate"`
+}
+
+// Pool is a bandwidth budget shared by every container labelled with
+// org.label-schema.tc.pool=<name>
+type Pool struct {
+	Upload   Limit `json:"upload"`
+	Download Limit `json:"download"`
+}
+
+// Limit is a rate/ceil pair, both accept the same values as tc
+type Limit struct {
+	Rate string `json:"rate"`
+	Ceil string `json:"ceil"`
+}
+
+func LoadConfig(path string) error {
+	Conf = &Config{}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read config file %s, error: %v", path, err)
+		}
+		if err := json.Unmarshal(b, Conf); err != nil {
+			return fmt.Errorf("failed to parse config file %s, error: %v", path, err)
+		}
+	}
+	if Conf.DistributionDir == "" {
+		Conf.DistributionDir = os.Getenv("TC_LIB_DIR")
+	}
+	if Conf.DistributionDir == "" {
+		Conf.DistributionDir = "/usr/lib/tc"
+	}
+	switch Conf.ForeignQdiscs {
+	case "":
+		Conf.ForeignQdiscs = ForeignQdiscsRefuse
+	case ForeignQdiscsRefuse, ForeignQdiscsForce:
+	default:
+		return fmt.Errorf("foreignQdiscs must be %s or %s, got %q", ForeignQdiscsRefuse, ForeignQdiscsForce, Conf.ForeignQdiscs)
+	}
+	if Conf.StateDir == "" {
+		Conf.StateDir = "/var/lib/tc-docker"
+	}
+	if Conf.TopologyFile != "" {
+		b, err := ioutil.ReadFile(Conf.TopologyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read topology file %s, error: %v", Conf.TopologyFile, err)
+		}
+		if err := json.Unmarshal(b, &Conf.Topology); err != nil {
+			return fmt.Errorf("failed to parse topology file %s, error: %v", Conf.TopologyFile, err)
+		}
+	}
+	for name, pool := range Conf.Pools {
+		if pool.Upload.Rate == "" || pool.Download.Rate == "" {
+			return fmt.Errorf("pool %s must define upload and download rate", name)
+		}
+		if pool.Upload.Ceil == "" {
+			pool.Upload.Ceil = pool.Upload.Rate
+		}
+		if pool.Download.Ceil == "" {
+			pool.Download.Ceil = pool.Download.Rate
+		}
+		Conf.Pools[name] = pool
+	}
+	return nil
+}
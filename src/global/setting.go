@@ -9,4 +9,7 @@ import (
 var (
 	DockerClient *client.Client
 	Ctx          context.Context
+	// Cancel cancels Ctx when the daemon stops
+	Cancel context.CancelFunc
+	Conf   = &Config{}
 )
@@ -0,0 +1,94 @@
+// Package api is the control interface of the daemon, a JSON over HTTP API served on a
+// unix socket so subcommands run with docker exec can query and change the running daemon
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Socket is the default path of the control socket
+const Socket = "/var/run/tc-docker.sock"
+
+var mux = http.NewServeMux()
+
+// Handle registers h for path, its result is sent back as JSON and errors are returned with status 400
+func Handle(path string, h func(r *http.Request) (interface{}, error)) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		result, err := h(r)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// Decode reads the JSON body of r into v
+func Decode(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid request: %v", err)
+	}
+	return nil
+}
+
+// Serve listens on socket, removing any stale socket left by a previous run
+func Serve(socket string) error {
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, mux)
+}
+
+// Call sends in as JSON to path of the daemon listening on socket and decodes its answer in out
+func Call(socket, method, path string, in, out interface{}) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://tc-docker"+path, &body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach daemon on %s: %v", socket, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e map[string]string
+		if json.Unmarshal(b, &e) == nil && e["error"] != "" {
+			return fmt.Errorf("%s", e["error"])
+		}
+		return fmt.Errorf("daemon answered %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 
-	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/internal/metrics"
+	"github.com/brenozd/tc-docker/pkg/cgroup"
+	"github.com/brenozd/tc-docker/pkg/netlink"
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/client"
 )
 
@@ -15,10 +18,15 @@ type Container struct {
 	ctx                context.Context
 	dc                 *client.Client
 	event              EventHandler
+	eventStream        chan events.Message
+	workers            int
 	ID                 string
 	Name               string
 	Veth               string
 	Ifb                string
+	Netns              string
+	Cgroup             string
+	Members            []string
 	DownloadRate       string
 	DownloadCeil       string
 	UploadRate         string
@@ -26,74 +34,279 @@ type Container struct {
 	LatencyDelay       string
 	LatencyVariation   string
 	LatencyCorrelation string
-	LossProbability    string
-	LossCorrelation    string
-	PacketDuplication  string
-	PacketCorruption   string
-	PacketReordering   string
+	// LatencyDistribution is the name of a netem distribution table
+	LatencyDistribution string
+	LossProbability     string
+	LossCorrelation     string
+	PacketDuplication   string
+	PacketCorruption    string
+	PacketReordering    string
+	Pool                string
+	Priority            string
+	Weight              string
+	Networks            []Network
+	Interface           Interface
+	UploadTuning        Tuning
+	DownloadTuning      Tuning
+	LossModel           LossModel
+	LossECN             string
+	Slot                Slot
+	Link                Link
+	// Partition lists the CIDRs, IPs or container names the container is cut from
+	Partition          string
+	PartitionDirection string
+	Region             string
+	// Schedule is either the name of a schedule in the daemon config or inline schedule windows
+	Schedule string
+	Quota    Quota
+	Credits  Credits
 }
 
-func NewContainer(ctx context.Context, dc *client.Client) *Container {
-	c := &Container{ctx: ctx, dc: dc}
+// Quota caps the bytes a container may transfer in each direction during Window, once a
+// quota is used up the direction is limited to its penalty rate until the window resets
+type Quota struct {
+	Upload          string
+	Download        string
+	Window          string
+	UploadPenalty   string
+	DownloadPenalty string
+}
+
+// Slot holds netem slotting parameters, packets are held and released in bursts at slot boundaries.
+// Slots last between Min and Max, or follow Distribution with Delay and Jitter when it is set.
+type Slot struct {
+	Min          string
+	Max          string
+	Distribution string
+	Delay        string
+	Jitter       string
+	Packets      string
+	Bytes        string
+}
+
+// Link holds the netem rate and the link-layer framing used to compute it
+type Link struct {
+	Rate         string
+	Overhead     string
+	CellSize     string
+	CellOverhead string
+}
+
+// LossModel holds the parameters of a correlated netem loss model, gemodel or state.
+// Params are kept in netem order and are empty for parameters without label.
+type LossModel struct {
+	Name   string
+	Params []string
+	// Conflict is the other loss model when labels of both are set, they cannot be used together
+	Conflict string
+	Seed     string
+}
+
+// Tuning holds optional HTB class parameters of one direction, empty values are computed from rate and MTU
+type Tuning struct {
+	Burst    string
+	Cburst   string
+	Quantum  string
+	Overhead string
+	// PacketRate is a packets per second limit enforced by a policer
+	PacketRate string
+}
+
+// Network is a docker network the container is attached to
+type Network struct {
+	Name   string
+	Driver string
+	// Bridge is the host bridge device, set only for bridge networks
+	Bridge string
+	IP     string
+	MAC    string
+}
+
+// eventQueueSize is how many docker events may wait for a worker before the stream is paused
+const eventQueueSize = 1024
+
+// NewContainer watches docker events, handling at most workers of them at once.
+// Scans also inspect at most workers containers at once.
+func NewContainer(ctx context.Context, dc *client.Client, workers int) *Container {
+	if workers < 1 {
+		workers = 1
+	}
+	c := &Container{ctx: ctx, dc: dc, workers: workers, event: InitEventHandler(workers, eventQueueSize), eventStream: make(chan events.Message)}
 	go c.eventWatch()
 	return c
 }
 
-func (c *Container) GetRunningList() ([]*Container, error) {
-	f := filters.NewArgs()
-	f.Add("label", "org.label-schema.tc.enabled=1")
-	f.Add("status", "running")
-	containerList, err := c.dc.ContainerList(c.ctx, types.ContainerListOptions{Filters: f})
+// EventMetrics returns the depth of the docker events queue
+func (c *Container) EventMetrics() []metrics.Metric {
+	return c.event.Metrics()
+}
+
+// GetRunningList discovers every running container with tc enabled. Containers are inspected once,
+// in parallel, against a single listing of the host veths. The ones that cannot be discovered
+// yet are returned as failures so they can be retried on their own.
+func (c *Container) GetRunningList() ([]*Container, []*StartError, error) {
+	containerList, err := c.runningList()
+	if err != nil {
+		return nil, nil, err
+	}
+	hostVeths, err := c.getHostVeths()
 	if err != nil {
-		return nil, fmt.Errorf("ContainerList error: %v", err)
+		return nil, nil, fmt.Errorf("getHostVeths error: %v", err)
 	}
 
+	found := make([][]*Container, len(containerList))
+	failures := make([]*StartError, len(containerList))
+	networks := &networkCache{m: make(map[string]types.NetworkResource)}
+	sem := make(chan struct{}, c.workers)
+	var wg sync.WaitGroup
+	for i, container := range containerList {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, container types.Container) {
+			defer func() { <-sem; wg.Done() }()
+			containers, err := c.discover(container.ID, containerList, hostVeths, networks)
+			if err != nil {
+				name := ""
+				if len(container.Names) > 0 {
+					name = strings.TrimLeft(container.Names[0], "/")
+				}
+				failures[i] = &StartError{ID: container.ID[:12], Name: name, Err: err}
+				return
+			}
+			found[i] = containers
+		}(i, container)
+	}
+	wg.Wait()
+
 	var containers []*Container
-	for _, container := range containerList {
-		name, err := c.getName(container.ID)
-		if err != nil {
-			return nil, fmt.Errorf("getName error: %v", err)
+	var failed []*StartError
+	// Containers sharing a network namespace are all discovered as its owner
+	seen := make(map[string]bool)
+	for i := range containerList {
+		for _, container := range found[i] {
+			if !seen[container.ID+"/"+container.Veth] {
+				seen[container.ID+"/"+container.Veth] = true
+				containers = append(containers, container)
+			}
 		}
-		sandboxKey, err := c.getSandboxKey(container.ID)
-		if err != nil {
-			return nil, fmt.Errorf("getSandboxKey error: %v", err)
+		if failures[i] != nil {
+			failed = append(failed, failures[i])
 		}
-		veths, err := c.GetVeths(name, sandboxKey)
+	}
+	return containers, failed, nil
+}
+
+// Discover returns the container with the given ID once for each of its veths
+func (c *Container) Discover(id string) ([]*Container, error) {
+	hostVeths, err := c.getHostVeths()
+	if err != nil {
+		return nil, err
+	}
+	running, err := c.runningList()
+	if err != nil {
+		return nil, err
+	}
+	return c.discover(id, running, hostVeths, &networkCache{m: make(map[string]types.NetworkResource)})
+}
+
+// discover inspects the container and builds it from its labels once for each of its interfaces paired with one of hostVeths.
+// A container sharing the network namespace of another one is built as the owner of the namespace, see sharedNetns.
+func (c *Container) discover(id string, running []types.Container, hostVeths map[int]netlink.Link, networks *networkCache) ([]*Container, error) {
+	cJson, err := c.dc.ContainerInspect(c.ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("ContainerInspect error: %v", err)
+	}
+	name := strings.TrimLeft(cJson.Name, "/")
+	if cJson.HostConfig != nil && cJson.HostConfig.NetworkMode.IsHost() {
+		// Host network containers have no interface of their own, their cgroup tells their traffic apart
+		path, err := cgroup.Path(cJson.State.Pid)
 		if err != nil {
-			return nil, fmt.Errorf("GetRunningList.getVeths error: %v", err)
+			return nil, fmt.Errorf("container: %s, %v", name, err)
 		}
-		downloadRate, downloadCeil, uploadRate, uploadCeil,
-			latencyDelay, latencyVariation, latencyCorrelation,
-			lossProbability, lossCorrelation,
-			packetDuplication, packetCorruption, packetReordering := c.getLabelTC(container.Labels)
-		for _, veth := range veths {
-			ifb, err := c.CreateIfb(name, veth)
-			if err != nil {
-				glog.Errorf("cannot create ifb for container %s, tc will not be running on this one", name)
-			}
-			containers = append(containers, &Container{
-				ID:                 container.ID[:12],
-				Name:               name,
-				Veth:               veth,
-				Ifb:                ifb,
-				DownloadRate:       downloadRate,
-				DownloadCeil:       downloadCeil,
-				UploadRate:         uploadRate,
-				UploadCeil:         uploadCeil,
-				LatencyDelay:       latencyDelay,
-				LatencyVariation:   latencyVariation,
-				LatencyCorrelation: latencyCorrelation,
-				LossProbability:    lossProbability,
-				LossCorrelation:    lossCorrelation,
-				PacketDuplication:  packetDuplication,
-				PacketCorruption:   packetCorruption,
-				PacketReordering:   packetReordering,
-			})
+		container := c.fromLabels(cJson.Config.Labels)
+		container.ID = id[:12]
+		container.Name = name
+		container.Cgroup = path
+		return []*Container{&container}, nil
+	}
+	cJson, labels, members, err := c.sharedNetns(cJson, running)
+	if err != nil {
+		return nil, err
+	}
+	id, name = cJson.ID, strings.TrimLeft(cJson.Name, "/")
+	nets, err := c.getNetworks(cJson, networks)
+	if err != nil {
+		return nil, fmt.Errorf("getNetworks error: %v", err)
+	}
+	interfaces, err := c.matchInterfaces(name, cJson.NetworkSettings.SandboxKey, nets, hostVeths)
+	if err != nil {
+		return nil, err
+	}
+	var containers []*Container
+	for _, iface := range interfaces {
+		container := c.fromLabels(labels)
+		if iface.HostVeth != "" {
+			container.Veth = iface.HostVeth
+			container.Ifb, err = c.CreateIfb(name, iface.HostVeth)
+		} else {
+			container.Veth = iface.Name
+			container.Netns = cJson.NetworkSettings.SandboxKey
+			container.Ifb, err = c.CreateNetnsIfb(container.Netns, iface.Name)
 		}
+		if err != nil {
+			return nil, err
+		}
+		container.ID = id[:12]
+		container.Name = name
+		container.Interface = iface
+		container.Members = members
+		container.Networks = nets
+		containers = append(containers, &container)
 	}
 	return containers, nil
 }
 
+// fromLabels returns a container holding the limits of the given labels
+func (c *Container) fromLabels(labels map[string]string) Container {
+	downloadRate, downloadCeil, uploadRate, uploadCeil,
+		latencyDelay, latencyVariation, latencyCorrelation,
+		lossProbability, lossCorrelation,
+		packetDuplication, packetCorruption, packetReordering := c.getLabelTC(labels)
+	priority, weight := c.getLabelPriority(labels)
+	slot, link, lossECN := c.getLabelNetem(labels)
+	partition, partitionDirection := c.getLabelPartition(labels)
+	return Container{
+		DownloadRate:        downloadRate,
+		DownloadCeil:        downloadCeil,
+		UploadRate:          uploadRate,
+		UploadCeil:          uploadCeil,
+		LatencyDelay:        latencyDelay,
+		LatencyVariation:    latencyVariation,
+		LatencyCorrelation:  latencyCorrelation,
+		LossProbability:     lossProbability,
+		LossCorrelation:     lossCorrelation,
+		PacketDuplication:   packetDuplication,
+		PacketCorruption:    packetCorruption,
+		PacketReordering:    packetReordering,
+		Pool:                c.getLabelPool(labels),
+		Priority:            priority,
+		Weight:              weight,
+		UploadTuning:        c.getLabelTuning(labels, "upload"),
+		DownloadTuning:      c.getLabelTuning(labels, "download"),
+		LossModel:           c.getLabelLossModel(labels),
+		LatencyDistribution: c.getLabelDistribution(labels),
+		LossECN:             lossECN,
+		Slot:                slot,
+		Link:                link,
+		Partition:           partition,
+		PartitionDirection:  partitionDirection,
+		Region:              c.getLabelRegion(labels),
+		Schedule:            c.getLabelSchedule(labels),
+		Quota:               c.getLabelQuota(labels),
+		Credits:             c.getLabelCredits(labels),
+	}
+}
+
 func (c *Container) getName(containerID string) (string, error) {
 	cJson, err := c.dc.ContainerInspect(c.ctx, containerID)
 	if err != nil {
@@ -102,14 +315,51 @@ func (c *Container) getName(containerID string) (string, error) {
 	return strings.TrimLeft(cJson.Name, "/"), nil
 }
 
-func (c *Container) getSandboxKey(containerID string) (string, error) {
-	cJson, err := c.dc.ContainerInspect(c.ctx, containerID)
+// networkCache holds the networks inspected during a scan, containers usually share a few of them
+type networkCache struct {
+	sync.Mutex
+	m map[string]types.NetworkResource
+}
+
+func (nc *networkCache) inspect(c *Container, id string) (types.NetworkResource, error) {
+	nc.Lock()
+	n, ok := nc.m[id]
+	nc.Unlock()
+	if ok {
+		return n, nil
+	}
+	n, err := c.dc.NetworkInspect(c.ctx, id)
 	if err != nil {
-		return "", err
+		return n, err
 	}
-	return cJson.NetworkSettings.SandboxKey, nil
+	nc.Lock()
+	nc.m[id] = n
+	nc.Unlock()
+	return n, nil
 }
 
+func (c *Container) getNetworks(cJson types.ContainerJSON, cache *networkCache) ([]Network, error) {
+	var networks []Network
+	for name, endpoint := range cJson.NetworkSettings.Networks {
+		n, err := cache.inspect(c, endpoint.NetworkID)
+		if err != nil {
+			return nil, err
+		}
+		network := Network{Name: name, Driver: n.Driver, IP: endpoint.IPAddress, MAC: endpoint.MacAddress}
+		if n.Driver == "bridge" {
+			network.Bridge = n.Options["com.docker.network.bridge.name"]
+			if network.Bridge == "" {
+				network.Bridge = "br-" + n.ID[:12]
+			}
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// DefaultRate is the rate of the directions without rate and ceil labels
+const DefaultRate = "10000mbps"
+
 func (c *Container) getLabelTC(labels map[string]string) (string, string, string, string, string, string, string, string, string, string, string, string) {
 	uploadRate, hasUploadRate := labels["org.label-schema.tc.upload.rate"]
 	uploadCeil, hasUploadCeil := labels["org.label-schema.tc.upload.ceil"]
@@ -126,8 +376,8 @@ func (c *Container) getLabelTC(labels map[string]string) (string, string, string
 
 	// Check for empty upload labels
 	if !hasUploadRate && !hasUploadCeil {
-		uploadRate = "10000mbps"
-		uploadCeil = "10000mbps"
+		uploadRate = DefaultRate
+		uploadCeil = DefaultRate
 	} else if hasUploadRate && !hasUploadCeil {
 		uploadCeil = uploadRate
 	} else if hasUploadCeil && !hasUploadRate {
@@ -136,8 +386,8 @@ func (c *Container) getLabelTC(labels map[string]string) (string, string, string
 
 	// Check for empty download labels
 	if !hasDownloadRate && !hasDownloadCeil {
-		downloadRate = "10000mbps"
-		downloadCeil = "10000mbps"
+		downloadRate = DefaultRate
+		downloadCeil = DefaultRate
 	} else if hasDownloadRate && !hasDownloadCeil {
 		downloadCeil = downloadRate
 	} else if hasDownloadRate && !hasDownloadCeil {
@@ -150,3 +400,128 @@ func (c *Container) getLabelTC(labels map[string]string) (string, string, string
 
 	return downloadRate, downloadCeil, uploadRate, uploadCeil, latencyDelay, latencyVariation, latencyCorrelation, lossProbability, lossCorrelation, packetDuplication, packetCorruption, packetReordering
 }
+
+func (c *Container) getLabelPool(labels map[string]string) string {
+	return labels["org.label-schema.tc.pool"]
+}
+
+func (c *Container) getLabelPriority(labels map[string]string) (string, string) {
+	return labels["org.label-schema.tc.priority"], labels["org.label-schema.tc.weight"]
+}
+
+func (c *Container) getLabelTuning(labels map[string]string, direction string) Tuning {
+	prefix := "org.label-schema.tc." + direction + "."
+	return Tuning{
+		Burst:      labels[prefix+"burst"],
+		Cburst:     labels[prefix+"cburst"],
+		Quantum:    labels[prefix+"quantum"],
+		Overhead:   labels[prefix+"overhead"],
+		PacketRate: labels[prefix+"pps"],
+	}
+}
+
+// LossModelParams lists, in netem order, the parameters of each loss model
+var LossModelParams = map[string][]string{
+	"gemodel": {"p", "r", "1-h", "1-k"},
+	"state":   {"p13", "p31", "p32", "p23", "p14"},
+}
+
+func (c *Container) getLabelLossModel(labels map[string]string) LossModel {
+	model := LossModel{Seed: labels["org.label-schema.tc.loss.seed"]}
+	for _, name := range []string{"gemodel", "state"} {
+		var params []string
+		found := false
+		for _, param := range LossModelParams[name] {
+			value, ok := labels["org.label-schema.tc.loss."+name+"."+param]
+			found = found || ok
+			params = append(params, value)
+		}
+		if !found {
+			continue
+		}
+		if model.Name != "" {
+			model.Conflict = name
+			break
+		}
+		model.Name, model.Params = name, params
+	}
+	return model
+}
+
+func (c *Container) getLabelDistribution(labels map[string]string) string {
+	return labels["org.label-schema.tc.latency.distribution"]
+}
+
+func (c *Container) getLabelNetem(labels map[string]string) (Slot, Link, string) {
+	slot := Slot{
+		Min:          labels["org.label-schema.tc.slot.min"],
+		Max:          labels["org.label-schema.tc.slot.max"],
+		Distribution: labels["org.label-schema.tc.slot.distribution"],
+		Delay:        labels["org.label-schema.tc.slot.delay"],
+		Jitter:       labels["org.label-schema.tc.slot.jitter"],
+		Packets:      labels["org.label-schema.tc.slot.packets"],
+		Bytes:        labels["org.label-schema.tc.slot.bytes"],
+	}
+	link := Link{
+		Rate:         labels["org.label-schema.tc.link.rate"],
+		Overhead:     labels["org.label-schema.tc.link.overhead"],
+		CellSize:     labels["org.label-schema.tc.link.cellsize"],
+		CellOverhead: labels["org.label-schema.tc.link.celloverhead"],
+	}
+	return slot, link, labels["org.label-schema.tc.loss.ecn"]
+}
+
+func (c *Container) getLabelPartition(labels map[string]string) (string, string) {
+	return labels["org.label-schema.tc.partition"], labels["org.label-schema.tc.partition.direction"]
+}
+
+func (c *Container) getLabelRegion(labels map[string]string) string {
+	return labels["org.label-schema.tc.region"]
+}
+
+func (c *Container) getLabelSchedule(labels map[string]string) string {
+	return labels["org.label-schema.tc.schedule"]
+}
+
+func (c *Container) getLabelQuota(labels map[string]string) Quota {
+	return Quota{
+		Upload:          labels["org.label-schema.tc.quota.upload"],
+		Download:        labels["org.label-schema.tc.quota.download"],
+		Window:          labels["org.label-schema.tc.quota.window"],
+		UploadPenalty:   labels["org.label-schema.tc.quota.upload.penalty"],
+		DownloadPenalty: labels["org.label-schema.tc.quota.download.penalty"],
+	}
+}
+
+// Credits emulates burstable links, a direction with a baseline accrues credits while it
+// sends less than its baseline and may use its rate and ceil until they run out
+type Credits struct {
+	UploadBaseline   string
+	UploadMax        string
+	DownloadBaseline string
+	DownloadMax      string
+}
+
+func (c *Container) getLabelCredits(labels map[string]string) Credits {
+	return Credits{
+		UploadBaseline:   labels["org.label-schema.tc.credits.upload.baseline"],
+		UploadMax:        labels["org.label-schema.tc.credits.upload.max"],
+		DownloadBaseline: labels["org.label-schema.tc.credits.download.baseline"],
+		DownloadMax:      labels["org.label-schema.tc.credits.download.max"],
+	}
+}
+
+// GetIPs returns the IPv4 addresses of the named container on every network it is attached to
+func (c *Container) GetIPs(name string) ([]string, error) {
+	cJson, err := c.dc.ContainerInspect(c.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, endpoint := range cJson.NetworkSettings.Networks {
+		if endpoint.IPAddress != "" {
+			ips = append(ips, endpoint.IPAddress)
+		}
+	}
+	return ips, nil
+}
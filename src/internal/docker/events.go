@@ -2,6 +2,7 @@ package docker
 
 import (
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/CodyGuo/glog"
@@ -10,94 +11,193 @@ import (
 	"github.com/docker/docker/api/types/filters"
 )
 
+// EventStart calls h for every veth of each started container and of each container queued by Restore.
+// Discovery and h are retried with backoff until they succeed or the container dies, the final failure
+// is sent as a *StartError.
 func (c *Container) EventStart(h func(Container) error) <-chan error {
-	errStream := make(chan error)
-	c.event.Handle("start", func(e events.Message) {
-		name, err := c.getName(e.ID)
-		if err != nil {
-			errStream <- err
-		}
-		sandboxKey, err := c.getSandboxKey(e.ID)
-		if err != nil {
-			errStream <- err
-			return
-		}
-		veths, err := c.GetVeths(name, sandboxKey)
-		if err != nil {
-			errStream <- err
-			return
-		}
-		downloadRate, downloadCeil, uploadRate, uploadCeil, 
-		latencyDelay, latencyVariation, latencyCorrelation, 
-		lossProbability, lossCorrelation, 
-		packetDuplication, packetCorruption, packetReordering := c.getLabelTC(e.Actor.Attributes)
-		for _, veth := range veths {
-			ifb, err := c.CreateIfb(name, veth)
-			if err != nil{
-				errStream <- err
-			}
-			err = h(Container{
-				ID:     e.ID[:12],
-				Name:   name,
-				Veth:   veth,
-				Ifb:	ifb,
-				DownloadRate : downloadRate,
-				DownloadCeil : downloadCeil,
-				UploadRate: uploadRate,
-				UploadCeil: uploadCeil,
-				LatencyDelay : latencyDelay,
-				LatencyVariation : latencyVariation,
-				LatencyCorrelation : latencyCorrelation,
-				LossProbability : lossProbability,
-				LossCorrelation : lossCorrelation,
-				PacketDuplication : packetDuplication,
-				PacketCorruption : packetCorruption,
-				PacketReordering : packetReordering,
-			})
-		}
-		if err != nil {
-			errStream <- err
+	errStream := make(chan error, errStreamSize)
+	handler := func(e events.Message) {
+		id := e.ID[:12]
+		err := c.Retry(id, func() error { return c.start(e, h) })
+		if err != nil && err != ErrRetryCancelled {
+			report(errStream, &StartError{ID: id, Name: e.Actor.Attributes["name"], Err: err})
 		}
-	})
+	}
+	c.event.Handle("start", handler)
+	c.event.Handle(actionRestore, handler)
 	return errStream
 }
 
+// Restore queues shaping the container again behind the events of the container not handled yet,
+// as its start would, so it never races them. It doesn't wait for the event to be queued so event
+// handlers may call it.
+func (c *Container) Restore(id, name string) {
+	go c.inject(events.Message{ID: id, Action: actionRestore, Actor: events.Actor{ID: id, Attributes: map[string]string{"name": name}}})
+}
+
+// Resync queues a scan of the running containers behind the events not handled yet
+func (c *Container) Resync() {
+	c.inject(events.Message{Action: actionResync})
+}
+
+// inject sends msg to the event stream, it gives up when ctx is done
+func (c *Container) inject(msg events.Message) {
+	select {
+	case c.eventStream <- msg:
+	case <-c.ctx.Done():
+	}
+}
+
+func (c *Container) start(e events.Message, h func(Container) error) error {
+	containers, err := c.Discover(e.ID)
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		if err := h(*container); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *Container) EventDie(h func(Container) error) <-chan error {
-	errStream := make(chan error)
+	errStream := make(chan error, errStreamSize)
 	c.event.Handle("die", func(e events.Message) {
 		name, err := c.getName(e.ID)
 		if err != nil {
-			errStream <- fmt.Errorf("getName error: %w", err)
+			report(errStream, fmt.Errorf("getName error: %w", err))
 		}
 		err = h(Container{
 			ID:   e.ID[:12],
 			Name: name,
 		})
 		if err != nil {
-			errStream <- err
+			report(errStream, err)
 		}
 	})
 	return errStream
 }
 
+// errStreamSize is how many handler errors are kept until the daemon reads them
+const errStreamSize = 64
+
+// report sends err to errStream without blocking the handler, it is logged instead when errStream is full
+func report(errStream chan<- error, err error) {
+	select {
+	case errStream <- err:
+	default:
+		glog.Errorf("Event handler error: %v", err)
+	}
+}
+
+// EventResync calls h whenever events may have been missed, e.g. dockerd restarted while
+// the stream was broken, so the running containers can be scanned again
+func (c *Container) EventResync(h func()) {
+	c.event.Handle(actionResync, func(events.Message) { h() })
+}
+
+const (
+	// actionResync is a synthetic event sent to the handlers when continuity is lost
+	actionResync = "tc-docker:resync"
+	// actionRestore is a synthetic event shaping a container again, sent by Restore
+	actionRestore     = "tc-docker:restore"
+	eventInitialDelay = time.Second
+	eventMaxDelay     = 30 * time.Second
+	// eventReplayWindow is how long the stream may be broken while the events missed
+	// are still expected to be replayed by dockerd
+	eventReplayWindow = time.Minute
+)
+
 func (c *Container) eventWatch() {
-	eventStream := make(chan events.Message)
-	go func() {
-		f := filters.NewArgs()
-		f.Add("type", "container")
-		f.Add("label", "org.label-schema.tc.enabled=1")
-		eventMsg, eventErr := c.dc.Events(c.ctx, types.EventsOptions{Filters: f})
-		for {
+	go c.subscribe(c.eventStream)
+	c.event.Watch(c.eventStream)
+}
+
+// subscribe forwards container events to eventStream. When the stream breaks it resubscribes
+// from the last event forwarded, backing off while dockerd is unreachable, and asks for a
+// resync when dockerd restarted or the events missed may no longer be replayed.
+func (c *Container) subscribe(eventStream chan<- events.Message) {
+	f := filters.NewArgs()
+	f.Add("type", "container")
+	f.Add("label", "org.label-schema.tc.enabled=1")
+
+	// last is the time of the last event forwarded and seen the events forwarded at that time,
+	// events at the same time are replayed by since
+	var last int64
+	seen := make(map[string]bool)
+	daemonID := c.daemonID()
+	delay := eventInitialDelay
+	for {
+		options := types.EventsOptions{Filters: f}
+		if last > 0 {
+			options.Since = fmt.Sprintf("%d.%09d", last/int64(time.Second), last%int64(time.Second))
+		}
+		eventMsg, eventErr := c.dc.Events(c.ctx, options)
+		var err error
+		for err == nil {
 			select {
-			case err := <-eventErr:
-				glog.Errorf("eventWatch failed, error: %v, Try again after 5 seconds", err)
-				time.Sleep(5 * time.Second)
-				eventMsg, eventErr = c.dc.Events(c.ctx, types.EventsOptions{Filters: f})
+			case err = <-eventErr:
 			case msg := <-eventMsg:
+				key := msg.ID + "/" + msg.Action
+				if msg.TimeNano < last || (msg.TimeNano == last && seen[key]) {
+					continue
+				}
+				if msg.TimeNano > last {
+					last = msg.TimeNano
+					seen = make(map[string]bool)
+				}
+				seen[key] = true
+				delay = eventInitialDelay
+				// The start of a dying container may still be waiting for a worker or retrying,
+				// it is cancelled until the container starts again
+				if msg.Action == "die" && len(msg.ID) >= 12 {
+					c.CancelRetry(msg.ID[:12])
+				}
+				if msg.Action == "start" && len(msg.ID) >= 12 {
+					c.ReviveRetry(msg.ID[:12])
+				}
 				eventStream <- msg
 			}
 		}
-	}()
-	c.event = InitEventHandler()
-	c.event.Watch(eventStream)
+		if c.ctx.Err() != nil {
+			return
+		}
+		broken := time.Now()
+		glog.Errorf("eventWatch failed, error: %v, try again after %v", err, delay)
+
+		// dockerd closes the stream when it shuts down, it may be back before the first ping
+		restarted := err == io.EOF
+		for {
+			time.Sleep(delay)
+			if delay *= 2; delay > eventMaxDelay {
+				delay = eventMaxDelay
+			}
+			_, err := c.dc.Ping(c.ctx)
+			if err == nil {
+				break
+			}
+			restarted = true
+			glog.Errorf("eventWatch, dockerd unreachable, error: %v, try again after %v", err, delay)
+		}
+
+		id := c.daemonID()
+		if restarted || id != daemonID || time.Since(broken) > eventReplayWindow {
+			glog.Warnf("eventWatch, events may have been missed, dockerd restarted: %t, daemon changed: %t, resyncing", restarted, id != daemonID)
+			daemonID = id
+			// Events from now on are handled by the new subscription, the ones before by the resync
+			last = time.Now().UnixNano()
+			seen = make(map[string]bool)
+			eventStream <- events.Message{Action: actionResync}
+		}
+	}
+}
+
+// daemonID returns the ID of the docker engine, it changes when another daemon answers
+func (c *Container) daemonID() string {
+	info, err := c.dc.Info(c.ctx)
+	if err != nil {
+		return ""
+	}
+	return info.ID
 }
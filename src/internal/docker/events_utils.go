@@ -7,6 +7,7 @@ import (
 	"sync"
 
 	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/internal/metrics"
 	eventtypes "github.com/docker/docker/api/types/events"
 )
 
@@ -15,16 +16,48 @@ import (
 type EventHandler interface {
 	Handle(action string, h func(eventtypes.Message))
 	Watch(c <-chan eventtypes.Message)
+	Stop()
+	Metrics() []metrics.Metric
 }
 
-// InitEventHandler initializes and returns an EventHandler
-func InitEventHandler() EventHandler {
-	return &eventHandler{handlers: make(map[string]func(eventtypes.Message))}
+// InitEventHandler initializes and returns an EventHandler running at most workers
+// handlers at once with at most queueSize events waiting
+func InitEventHandler(workers, queueSize int) EventHandler {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < workers {
+		queueSize = workers
+	}
+	return &eventHandler{
+		handlers: make(map[string]func(eventtypes.Message)),
+		workers:  workers,
+		slots:    make(chan struct{}, queueSize),
+		ready:    make(chan string, queueSize),
+		pending:  make(map[string][]eventtypes.Message),
+		quit:     make(chan struct{}),
+	}
 }
 
 type eventHandler struct {
 	handlers map[string]func(eventtypes.Message)
 	mu       sync.Mutex
+
+	workers int
+	// slots bounds the events queued or being handled, Watch blocks when it is full
+	slots chan struct{}
+	// ready holds the containers with events to handle, each at most once
+	ready chan string
+	// pending holds the events of each container in arrival order, a container is
+	// in pending from its first queued event until its last one is handled
+	pending  map[string][]eventtypes.Message
+	queued   int
+	inFlight int
+	handled  uint64
+	// quit is closed by Stop, running waits for the handlers started before
+	quit    chan struct{}
+	stopped bool
+	running sync.WaitGroup
 }
 
 func (w *eventHandler) Handle(action string, h func(eventtypes.Message)) {
@@ -35,16 +68,103 @@ func (w *eventHandler) Handle(action string, h func(eventtypes.Message)) {
 
 // Watch ranges over the passed in event chan and processes the events based on the
 // handlers created for a given action.
+// Events of the same container are handled one at a time in the order they arrived,
+// events of different containers concurrently by the workers.
 // To stop watching, close the event chan.
 func (w *eventHandler) Watch(c <-chan eventtypes.Message) {
+	for i := 0; i < w.workers; i++ {
+		go w.work()
+	}
 	for e := range c {
 		w.mu.Lock()
-		h, exists := w.handlers[e.Action]
+		_, exists := w.handlers[e.Action]
 		w.mu.Unlock()
 		if !exists {
 			continue
 		}
 		glog.Debugf("event handler: received event: %v", e)
-		go h(e)
+		w.slots <- struct{}{}
+		// Docker events carry the full ID and the synthetic ones the short ID, both queue together
+		id := e.ID
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		w.mu.Lock()
+		events, active := w.pending[id]
+		w.pending[id] = append(events, e)
+		w.queued++
+		w.mu.Unlock()
+		if !active {
+			w.ready <- id
+		}
+	}
+}
+
+// work handles the next event of each ready container, the container is ready again
+// afterwards if it has more events so others are not starved
+func (w *eventHandler) work() {
+	for {
+		var id string
+		select {
+		case <-w.quit:
+			return
+		case id = <-w.ready:
+		}
+		w.mu.Lock()
+		if w.stopped {
+			w.mu.Unlock()
+			return
+		}
+		w.running.Add(1)
+		e := w.pending[id][0]
+		w.pending[id] = w.pending[id][1:]
+		w.queued--
+		w.inFlight++
+		h := w.handlers[e.Action]
+		w.mu.Unlock()
+
+		h(e)
+		w.running.Done()
+
+		w.mu.Lock()
+		w.inFlight--
+		w.handled++
+		more := len(w.pending[id]) > 0
+		if !more {
+			delete(w.pending, id)
+		}
+		w.mu.Unlock()
+		<-w.slots
+		if more {
+			w.ready <- id
+		}
+	}
+}
+
+// Stop stops handing events to the handlers and waits for the ones running to return,
+// the events still queued are dropped
+func (w *eventHandler) Stop() {
+	w.mu.Lock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.quit)
+	}
+	w.mu.Unlock()
+	w.running.Wait()
+}
+
+// Metrics returns the depth of the event queue
+func (w *eventHandler) Metrics() []metrics.Metric {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return []metrics.Metric{
+		{Name: "tc_docker_events_queued", Help: "Docker events waiting for a worker.", Type: "gauge",
+			Samples: []metrics.Sample{{Value: float64(w.queued)}}},
+		{Name: "tc_docker_events_in_flight", Help: "Docker events being handled.", Type: "gauge",
+			Samples: []metrics.Sample{{Value: float64(w.inFlight)}}},
+		{Name: "tc_docker_events_handled_total", Help: "Docker events handled since the daemon started.", Type: "counter",
+			Samples: []metrics.Sample{{Value: float64(w.handled)}}},
+		{Name: "tc_docker_events_workers", Help: "Docker events handled at most at once.", Type: "gauge",
+			Samples: []metrics.Sample{{Value: float64(w.workers)}}},
 	}
 }
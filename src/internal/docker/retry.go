@@ -0,0 +1,151 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodyGuo/glog"
+	"github.com/docker/docker/client"
+)
+
+const (
+	retryInitialDelay = 500 * time.Millisecond
+	retryMaxDelay     = 30 * time.Second
+	retryAttempts     = 8
+	// deadTTL is how long a dead container is remembered, longer than a start may wait for a worker
+	deadTTL = 10 * time.Minute
+)
+
+// ErrRetryCancelled is returned by Retry when the container died before f succeeded
+var ErrRetryCancelled = errors.New("retry cancelled, container died")
+
+// StartError is the failure to shape a container once every retry is used up
+type StartError struct {
+	ID   string
+	Name string
+	Err  error
+}
+
+func (e *StartError) Error() string {
+	return fmt.Sprintf("container: %s, id: %s, error: %v", e.Name, e.ID, e.Err)
+}
+
+type retry struct {
+	cancel context.CancelFunc
+}
+
+// retries holds the pending retries, keyed by the short ID of the container optionally
+// followed by / and the veth retried, and when the containers that died since their last
+// start died, so a start still waiting for a worker when its container dies is never run
+// running counts the Retry calls in progress, it is only added to before the context is cancelled.
+var retries = struct {
+	sync.Mutex
+	m       map[string]*retry
+	dead    map[string]time.Time
+	running sync.WaitGroup
+}{m: make(map[string]*retry), dead: make(map[string]time.Time)}
+
+// Retry runs f until it succeeds, waiting twice as long after each failure up to retryMaxDelay.
+// The error of the last attempt is returned after retryAttempts attempts, ErrRetryCancelled
+// when the container is gone or CancelRetry is called for it meanwhile or was before, unless
+// the container started again since. A new Retry with the same key cancels the previous one.
+func (c *Container) Retry(key string, f func() error) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	r := &retry{cancel: cancel}
+	id := strings.SplitN(key, "/", 2)[0]
+	retries.Lock()
+	if _, dead := retries.dead[id]; dead || c.ctx.Err() != nil {
+		retries.Unlock()
+		cancel()
+		return ErrRetryCancelled
+	}
+	retries.running.Add(1)
+	if previous, ok := retries.m[key]; ok {
+		previous.cancel()
+	}
+	retries.m[key] = r
+	retries.Unlock()
+	defer func() {
+		retries.Lock()
+		if retries.m[key] == r {
+			delete(retries.m, key)
+		}
+		retries.Unlock()
+		cancel()
+		retries.running.Done()
+	}()
+
+	delay := retryInitialDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if attempt == retryAttempts {
+			return err
+		}
+		if c.gone(id) {
+			return ErrRetryCancelled
+		}
+		glog.Warnf("Attempt %d/%d failed, key: %s, retrying in %v, error: %v", attempt, retryAttempts, key, delay, err)
+		select {
+		case <-ctx.Done():
+			return ErrRetryCancelled
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// CancelRetry stops the pending retries of the container, if any, and the ones started
+// until ReviveRetry is called for it
+func (c *Container) CancelRetry(id string) {
+	retries.Lock()
+	now := time.Now()
+	for dead, at := range retries.dead {
+		if now.Sub(at) > deadTTL {
+			delete(retries.dead, dead)
+		}
+	}
+	retries.dead[id] = now
+	for key, r := range retries.m {
+		if key == id || strings.HasPrefix(key, id+"/") {
+			r.cancel()
+			delete(retries.m, key)
+		}
+	}
+	retries.Unlock()
+}
+
+// Stop waits for the event handlers and retries running to return once the context of
+// the container is cancelled, no event is handled afterwards
+func (c *Container) Stop() {
+	c.event.Stop()
+	// Retries check the context under the lock before adding themselves to running
+	retries.Lock()
+	retries.Unlock()
+	retries.running.Wait()
+}
+
+// gone tells whether the container is no longer running, its die event may not be read yet
+func (c *Container) gone(id string) bool {
+	cJson, err := c.dc.ContainerInspect(c.ctx, id)
+	if client.IsErrNotFound(err) {
+		return true
+	}
+	return err == nil && cJson.State != nil && !cJson.State.Running
+}
+
+// ReviveRetry allows retries of a container started again after CancelRetry
+func (c *Container) ReviveRetry(id string) {
+	retries.Lock()
+	delete(retries.dead, id)
+	retries.Unlock()
+}
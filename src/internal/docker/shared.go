@@ -0,0 +1,84 @@
+package docker
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	containertypes "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const labelPrefix = "org.label-schema.tc."
+
+// sharedNetns resolves the network namespace of a container started with --network container:<owner>.
+// The namespace is shaped once, as its owner, with the labels of the owner taking precedence and the
+// ones it lacks taken from the containers joined to it, earliest created first. Members are the
+// running containers with tc enabled in the namespace, owner first, it is released with the last one.
+func (c *Container) sharedNetns(cJson types.ContainerJSON, running []types.Container) (types.ContainerJSON, map[string]string, []string, error) {
+	owner := cJson
+	if cJson.HostConfig.NetworkMode.IsContainer() {
+		var err error
+		owner, err = c.dc.ContainerInspect(c.ctx, cJson.HostConfig.NetworkMode.ConnectedContainer())
+		if err != nil {
+			return owner, nil, nil, fmt.Errorf("ContainerInspect error, network namespace owner: %v", err)
+		}
+	}
+
+	var joined []types.Container
+	listed := false
+	for _, r := range running {
+		mode := containertypes.NetworkMode(r.HostConfig.NetworkMode)
+		if mode.IsContainer() && refersTo(mode.ConnectedContainer(), owner) {
+			joined = append(joined, r)
+			listed = listed || r.ID == cJson.ID
+		}
+	}
+	if owner.ID != cJson.ID && !listed {
+		// The container just started may not be listed yet, it is the latest member
+		joined = append(joined, types.Container{ID: cJson.ID, Created: math.MaxInt64, Labels: cJson.Config.Labels})
+	}
+	sort.Slice(joined, func(i, j int) bool {
+		if joined[i].Created != joined[j].Created {
+			return joined[i].Created < joined[j].Created
+		}
+		return joined[i].ID < joined[j].ID
+	})
+
+	labels := make(map[string]string)
+	var members []string
+	if owner.State != nil && owner.State.Running && owner.Config.Labels[labelPrefix+"enabled"] == "1" {
+		for k, v := range owner.Config.Labels {
+			labels[k] = v
+		}
+		members = append(members, owner.ID[:12])
+	}
+	for _, j := range joined {
+		members = append(members, j.ID[:12])
+		for k, v := range j.Labels {
+			if _, ok := labels[k]; !ok && strings.HasPrefix(k, labelPrefix) {
+				labels[k] = v
+			}
+		}
+	}
+	return owner, labels, members, nil
+}
+
+// refersTo tells whether ref, as given to --network container:<ref>, is the container
+func refersTo(ref string, cJson types.ContainerJSON) bool {
+	return ref == strings.TrimLeft(cJson.Name, "/") || (len(ref) > 0 && strings.HasPrefix(cJson.ID, ref))
+}
+
+// runningList lists the running containers with tc enabled
+func (c *Container) runningList() ([]types.Container, error) {
+	f := filters.NewArgs()
+	f.Add("label", labelPrefix+"enabled=1")
+	f.Add("status", "running")
+	containerList, err := c.dc.ContainerList(c.ctx, types.ContainerListOptions{Filters: f})
+	if err != nil {
+		return nil, fmt.Errorf("ContainerList error: %v", err)
+	}
+	return containerList, nil
+}
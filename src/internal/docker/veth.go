@@ -1,64 +1,151 @@
 package docker
 
 import (
-	"bufio"
-	"bytes"
-	"errors"
 	"fmt"
+	"net"
 	"os"
 	"strings"
 	"io/ioutil"
 
 	"github.com/CodyGuo/glog"
 	"github.com/brenozd/tc-docker/pkg/command"
+	"github.com/brenozd/tc-docker/pkg/netlink"
+	"github.com/brenozd/tc-docker/pkg/netns"
 )
 
-type Veth struct {
-	Device    string
-	Ident     string
-	LinkIdent string
+// maxIfNameLen is the longest name of a network interface
+const maxIfNameLen = 15
+
+// Interface is a network interface of a container paired with the host side of its veth, Container.Veth.
+// Interfaces of other networks than bridges, e.g. macvlan or ipvlan, have no veth peer on the host
+// and are shaped inside the container network namespace, Container.Netns, instead.
+type Interface struct {
+	// Name and Index identify the interface inside the container network namespace
+	Name  string
+	Index int
+	MAC   string
+	IPs   []string
+	// HostVeth and HostIndex identify the peer of the interface on the host, empty
+	// when the interface is shaped inside the container network namespace
+	HostVeth  string
+	HostIndex int
+	// Network is the docker network the interface is attached to, empty when unknown
+	Network string
 }
 
-func (c *Container) GetVeths(name, sandboxKey string) ([]string, error) {
-	containerVeths, err := c.getContainerVeths(name, sandboxKey)
+// matchInterfaces pairs the interfaces of the container with their peer among hostVeths,
+// listed once for every container of a scan
+func (c *Container) matchInterfaces(name, sandboxKey string, networks []Network, hostVeths map[int]netlink.Link) ([]Interface, error) {
+	links, addrs, err := c.getContainerLinks(sandboxKey)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("container: %s, %v", name, err)
 	}
-	hostVeths, err := c.getHostVeths()
-	if err != nil {
-		return nil, err
+	return pairInterfaces(name, links, addrs, networks, hostVeths)
+}
+
+// pairInterfaces pairs the links of a container with their peer among hostVeths. An interface
+// is paired with the host veth whose index is its link index and whose own link index is the
+// interface. Interfaces without peer are kept when they belong to a docker network shaped in the namespace.
+func pairInterfaces(name string, links []netlink.Link, addrs map[int][]string, networks []Network, hostVeths map[int]netlink.Link) ([]Interface, error) {
+	var interfaces []Interface
+	for _, link := range links {
+		if !link.Up || link.Loopback {
+			continue
+		}
+		iface := Interface{
+			Name:  link.Name,
+			Index: link.Index,
+			MAC:   link.MAC,
+			IPs:   addrs[link.Index],
+		}
+		network, known := interfaceNetwork(iface, networks)
+		iface.Network = network.Name
+		if host, ok := hostVeths[link.PeerIndex]; ok && host.PeerIndex == link.Index {
+			iface.HostVeth, iface.HostIndex = host.Name, host.Index
+		} else if !known || !shapedInNetns(network.Driver) {
+			continue
+		}
+		glog.Debugf("matchInterfaces found, container: %s, interface: %+v", name, iface)
+		interfaces = append(interfaces, iface)
+	}
+	if len(interfaces) == 0 {
+		return nil, fmt.Errorf("container: %s, not found veth", name)
 	}
-	veths := []string{}
-	for _, hv := range hostVeths {
-		for _, cv := range containerVeths {
-			if cv.Ident == hv.LinkIdent && cv.LinkIdent == hv.Ident {
-				glog.Debugf("GetVeths found, container: %s, device: %s, veth: %+v", name, hv.Device, *cv)
-				veths = append(veths, hv.Device)
+	return interfaces, nil
+}
+
+// interfaceNetwork returns the docker network whose endpoint has the MAC, or else one of the IPs, of the interface.
+// ipvlan endpoints share the MAC of their parent, so the IP decides for them.
+func interfaceNetwork(iface Interface, networks []Network) (Network, bool) {
+	for _, network := range networks {
+		if network.MAC != "" && strings.EqualFold(network.MAC, iface.MAC) {
+			return network, true
+		}
+	}
+	for _, network := range networks {
+		for _, ip := range iface.IPs {
+			if network.IP != "" && network.IP == ip {
+				return network, true
 			}
 		}
 	}
-	if len(veths) == 0 {
-		return nil, fmt.Errorf("container: %s, not found veth", name)
+	return Network{}, false
+}
+
+// shapedInNetns tells whether the interfaces of a network driver are shaped inside the
+// container network namespace, every driver but bridge leaves no veth peer on the host
+func shapedInNetns(driver string) bool {
+	return driver != "bridge"
+}
+
+// CreateNetnsIfb creates the ifb handling the ingress traffic of iface inside the network
+// namespace at sandboxKey, the ifb goes away along with the namespace
+func (c *Container) CreateNetnsIfb(sandboxKey, iface string) (string, error) {
+	ifb := "ifb" + iface
+	if len(ifb) > maxIfNameLen {
+		ifb = ifb[:maxIfNameLen]
+	}
+	err := netns.Do(sandboxKey, func() error {
+		if _, err := net.InterfaceByName(ifb); err != nil {
+			cmd := fmt.Sprintf("/usr/sbin/ip link add name %s type ifb", ifb)
+			glog.Debug(cmd)
+			out, err := command.CombinedOutput(cmd)
+			if err != nil {
+				return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+			}
+		}
+		cmd := fmt.Sprintf("/usr/sbin/ip link set dev %s up", ifb)
+		glog.Debug(cmd)
+		out, err := command.CombinedOutput(cmd)
+		if err != nil {
+			return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
-	return veths, nil
+	return ifb, nil
 }
 
 func (c *Container) CreateIfb(name, veth string) (string, error) {
 	id:= strings.ReplaceAll(veth, "veth", "")
 	ifb:=fmt.Sprintf("ifb%s", id)
 
-	// Create ifb to handle ingress traffic
-	cmd := fmt.Sprintf("/usr/sbin/ip link add name %s type ifb", ifb)
-	glog.Debug(cmd)
-	out, err := command.CombinedOutput(cmd)
-	if err != nil {
-		return "", fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+	// Create ifb to handle ingress traffic, unless it is left by a previous attempt
+	if _, err := os.Stat("/sys/class/net/" + ifb); os.IsNotExist(err) {
+		cmd := fmt.Sprintf("/usr/sbin/ip link add name %s type ifb", ifb)
+		glog.Debug(cmd)
+		out, err := command.CombinedOutput(cmd)
+		if err != nil {
+			return "", fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+		}
 	}
 
 	// Set ifb up 
-	cmd = fmt.Sprintf("/usr/sbin/ip link set dev %s up", ifb)
+	cmd := fmt.Sprintf("/usr/sbin/ip link set dev %s up", ifb)
 	glog.Debug(cmd)
-	out, err = command.CombinedOutput(cmd)
+	out, err := command.CombinedOutput(cmd)
 	if err != nil {
 		return "", fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
 	}
@@ -106,84 +193,35 @@ func (c *Container) RemoveIfb(name string) error {
 	return nil
 }
 
-func (c *Container) RemoveVeth(name string) error {
-	veth := "/var/run/netns/" + name
-	glog.Debugf("RemoveVeth: %s", veth)
-	return os.Remove(veth)
-}
-
-func (c *Container) getHostVeths() ([]*Veth, error) {
-	ipAddrCmd := "/usr/sbin/ip addr show type veth"
-	glog.Debug(ipAddrCmd)
-	out, err := command.CombinedOutput(ipAddrCmd)
+// getHostVeths returns the veths of the host keyed by interface index
+func (c *Container) getHostVeths() (map[int]netlink.Link, error) {
+	links, err := netlink.Links()
 	if err != nil {
-		return nil, fmt.Errorf("out: %s, error: %v", out, err)
+		return nil, err
 	}
-	var veths []*Veth
-	scanner := bufio.NewScanner(bytes.NewReader(out))
-	for scanner.Scan() {
-		b := scanner.Bytes()
-		if !bytes.Contains(b, []byte("veth")) {
-			continue
-		}
-		veth, err := parseVeth(b)
-		if err != nil {
-			glog.Errorf("getHostVeths, parseVeth: %v, veth: %s", err, b)
-			continue
+	veths := make(map[int]netlink.Link)
+	for _, link := range links {
+		if link.Kind == "veth" {
+			veths[link.Index] = link
 		}
-		veths = append(veths, &veth)
 	}
 	return veths, nil
 }
 
-func (c *Container) getContainerVeths(name, sandboxKey string) ([]*Veth, error) {
-	os.Remove("/var/run/netns/" + name)
-	if err := os.Symlink(sandboxKey, "/var/run/netns/"+name); err != nil {
-		return nil, err
-	}
-	ipAddrCmd := fmt.Sprintf("/usr/sbin/ip netns exec %s ip addr show ", name)
-	glog.Debug(ipAddrCmd)
-	out, err := command.CombinedOutput(ipAddrCmd)
-	if err != nil {
-		return nil, fmt.Errorf("out: %s, error: %v", out, err)
-	}
-	var veths []*Veth
-	scanner := bufio.NewScanner(bytes.NewReader(out))
-	for scanner.Scan() {
-		b := scanner.Bytes()
-		if !bytes.Contains(b, []byte("UP")) {
-			continue
-		}
-		if bytes.Contains(b, []byte("LOOPBACK")) {
-			continue
+// getContainerLinks returns the links of the network namespace at sandboxKey and their IPv4 addresses keyed by link index
+func (c *Container) getContainerLinks(sandboxKey string) ([]netlink.Link, map[int][]string, error) {
+	var links []netlink.Link
+	var addrs map[int][]string
+	err := netns.Do(sandboxKey, func() error {
+		var err error
+		if links, err = netlink.Links(); err != nil {
+			return err
 		}
-		veth, err := parseVeth(b)
-		if err != nil {
-			glog.Errorf("getContainerVeths, parseVeth: %v, veth: %s", err, b)
-			continue
-		}
-		veths = append(veths, &veth)
+		addrs, err = netlink.Addrs()
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-	return veths, nil
-}
-
-func parseVeth(b []byte) (Veth, error) {
-	fields := bytes.Split(b, []byte(":"))
-	if len(fields) < 2 {
-		return Veth{}, errors.New("not found")
-	}
-	ident := bytes.TrimSpace(fields[0])
-	devices := bytes.Split(bytes.TrimSpace(fields[1]), []byte("@if"))
-	if len(devices) < 2 {
-		return Veth{}, errors.New("not found")
-
-	}
-	device := devices[0]
-	link := devices[1]
-	glog.Debugf("parseVeth, ident: %s, device: %s, link: %s", ident, device, link)
-	return Veth{
-		Device:    string(devices[0]),
-		Ident:     string(ident),
-		LinkIdent: string(devices[1]),
-	}, nil
+	return links, addrs, nil
 }
@@ -0,0 +1,79 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/brenozd/tc-docker/pkg/netlink"
+)
+
+func TestPairInterfaces(t *testing.T) {
+	networks := []Network{
+		{Name: "web", Driver: "bridge", Bridge: "br-web", IP: "172.18.0.2", MAC: "02:42:ac:12:00:02"},
+		{Name: "lan", Driver: "macvlan", IP: "192.168.1.50", MAC: "02:42:c0:a8:01:32"},
+		{Name: "l3", Driver: "ipvlan", IP: "10.10.0.5", MAC: "52:54:00:12:34:56"},
+	}
+	hostVeths := map[int]netlink.Link{
+		25: {Index: 25, Name: "veth1a2b3c", Kind: "veth", PeerIndex: 10},
+		26: {Index: 26, Name: "veth4d5e6f", Kind: "veth", PeerIndex: 99},
+	}
+	lo := netlink.Link{Index: 1, Name: "lo", Up: true, Loopback: true}
+	bridged := netlink.Link{Index: 10, Name: "eth0", MAC: "02:42:ac:12:00:02", PeerIndex: 25, Up: true}
+	tests := []struct {
+		name  string
+		links []netlink.Link
+		addrs map[int][]string
+		want  []Interface
+		ok    bool
+	}{
+		{
+			name:  "bridge",
+			links: []netlink.Link{lo, bridged},
+			addrs: map[int][]string{10: {"172.18.0.2"}},
+			want:  []Interface{{Name: "eth0", Index: 10, MAC: "02:42:ac:12:00:02", IPs: []string{"172.18.0.2"}, HostVeth: "veth1a2b3c", HostIndex: 25, Network: "web"}},
+			ok:    true,
+		},
+		{
+			name:  "peer of another namespace",
+			links: []netlink.Link{{Index: 11, Name: "eth0", MAC: "02:42:ac:12:00:02", PeerIndex: 26, Up: true}},
+			ok:    false,
+		},
+		{
+			name:  "down",
+			links: []netlink.Link{{Index: 10, Name: "eth0", MAC: "02:42:ac:12:00:02", PeerIndex: 25}},
+			ok:    false,
+		},
+		{
+			name:  "macvlan",
+			links: []netlink.Link{lo, bridged, {Index: 12, Name: "eth1", MAC: "02:42:C0:A8:01:32", PeerIndex: 3, Up: true}},
+			addrs: map[int][]string{12: {"192.168.1.50"}},
+			want: []Interface{
+				{Name: "eth0", Index: 10, MAC: "02:42:ac:12:00:02", HostVeth: "veth1a2b3c", HostIndex: 25, Network: "web"},
+				{Name: "eth1", Index: 12, MAC: "02:42:C0:A8:01:32", IPs: []string{"192.168.1.50"}, Network: "lan"},
+			},
+			ok: true,
+		},
+		{
+			name:  "ipvlan by address",
+			links: []netlink.Link{{Index: 13, Name: "eth0", MAC: "52:54:00:aa:bb:cc", PeerIndex: 2, Up: true}},
+			addrs: map[int][]string{13: {"10.10.0.5"}},
+			want:  []Interface{{Name: "eth0", Index: 13, MAC: "52:54:00:aa:bb:cc", IPs: []string{"10.10.0.5"}, Network: "l3"}},
+			ok:    true,
+		},
+		{
+			name:  "unknown network",
+			links: []netlink.Link{lo, {Index: 14, Name: "wg0", Up: true}},
+			ok:    false,
+		},
+	}
+	for _, tt := range tests {
+		got, err := pairInterfaces("test", tt.links, tt.addrs, networks, hostVeths)
+		if (err == nil) != tt.ok {
+			t.Errorf("pairInterfaces(%s) error = %v, want ok %t", tt.name, err, tt.ok)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pairInterfaces(%s) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
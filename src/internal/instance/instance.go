@@ -0,0 +1,183 @@
+// Package instance keeps a single tc-docker daemon shaping a host. The lock is a file locked with
+// flock in the state directory together with an abstract unix socket, both released by the kernel
+// with the process however it exits. Abstract sockets belong to a network namespace, the file keeps
+// daemons in other namespaces out too. The holder answers on the socket with its pid and hands the
+// host over to a newer instance asking for it.
+package instance
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/CodyGuo/glog"
+)
+
+// Name is the abstract unix socket held by the running daemon
+const Name = "@tc-docker"
+
+// lockFile is the file locked by the running daemon in the state directory
+const lockFile = "tc-docker.lock"
+
+// What a daemon does when another one holds the lock
+const (
+	OnConflictExit     = "exit"
+	OnConflictWait     = "wait"
+	OnConflictTakeover = "takeover"
+)
+
+// takeoverTimeout bounds the time the holder takes to release the lock once asked to hand over
+const takeoverTimeout = 30 * time.Second
+
+// HeldError is returned when another daemon holds the lock
+type HeldError struct {
+	Pid string
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("another tc-docker instance is running, pid %s", e.Pid)
+}
+
+// Lock is the held instance lock
+type Lock struct {
+	l       net.Listener
+	f       *os.File
+	handoff chan struct{}
+	once    sync.Once
+}
+
+// Acquire takes the instance lock of the state directory, onConflict tells what to do when another daemon holds it
+func Acquire(onConflict, stateDir string) (*Lock, error) {
+	switch onConflict {
+	case OnConflictExit, OnConflictWait, OnConflictTakeover:
+	default:
+		return nil, fmt.Errorf("invalid on-conflict %q, must be %s, %s or %s", onConflict, OnConflictExit, OnConflictWait, OnConflictTakeover)
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(stateDir, lockFile)
+	lock, err := tryLock(path)
+	if err != nil || lock != nil {
+		return lock, err
+	}
+	pid, queryErr := query("pid")
+	if queryErr != nil {
+		return nil, fmt.Errorf("instance lock %s is taken and its holder doesn't answer on %s, it may run in another network namespace, error: %v", path, Name, queryErr)
+	}
+
+	switch onConflict {
+	case OnConflictExit:
+		return nil, &HeldError{Pid: pid}
+	case OnConflictWait:
+		glog.Infof("Another tc-docker instance is running, pid %s, waiting for it to exit", pid)
+		for {
+			time.Sleep(time.Second)
+			if lock, err := tryLock(path); err != nil || lock != nil {
+				return lock, err
+			}
+		}
+	}
+
+	glog.Infof("Another tc-docker instance is running, pid %s, taking over", pid)
+	if _, err := query("takeover"); err != nil {
+		return nil, fmt.Errorf("takeover from pid %s failed, error: %v", pid, err)
+	}
+	deadline := time.Now().Add(takeoverTimeout)
+	for time.Now().Before(deadline) {
+		if lock, err := tryLock(path); err != nil || lock != nil {
+			return lock, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("pid %s didn't hand over in %s", pid, takeoverTimeout)
+}
+
+// query sends a request to the holder of the lock and returns its answer
+func query(request string) (string, error) {
+	conn, err := net.DialTimeout("unix", Name, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintln(conn, request); err != nil {
+		return "", err
+	}
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+// tryLock takes the lock file at path and the socket, it returns no lock when another daemon holds either
+func tryLock(path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open instance lock %s: %v", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("lock instance lock %s: %v", path, err)
+	}
+	l, err := net.Listen("unix", Name)
+	if err != nil {
+		f.Close()
+		return nil, nil
+	}
+	f.Truncate(0)
+	fmt.Fprintln(f, os.Getpid())
+	return serve(l, f), nil
+}
+
+func serve(l net.Listener, f *os.File) *Lock {
+	lock := &Lock{l: l, f: f, handoff: make(chan struct{})}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go lock.answer(conn)
+		}
+	}()
+	return lock
+}
+
+// answer replies to a request of another instance, pid or takeover, with the pid of the daemon.
+// A takeover is acknowledged right away, the lock is released once the daemon stopped.
+func (lock *Lock) answer(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(conn, strconv.Itoa(os.Getpid()))
+	if strings.TrimSpace(request) == "takeover" {
+		lock.once.Do(func() { close(lock.handoff) })
+	}
+}
+
+// Handoff is closed when another instance asks to take over, the daemon must stop changing
+// the host and call Release, the shaping in place is left to the new instance
+func (lock *Lock) Handoff() <-chan struct{} {
+	return lock.handoff
+}
+
+// Release gives up the lock
+func (lock *Lock) Release() {
+	lock.l.Close()
+	lock.f.Close()
+}
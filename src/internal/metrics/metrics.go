@@ -0,0 +1,86 @@
+// Package metrics exposes the state of the daemon in the Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metric is one metric family, Type is either gauge or counter
+type Metric struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// Sample is a value of a metric for one set of labels
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+var collectors = struct {
+	sync.Mutex
+	fs []func() []Metric
+}{}
+
+// Register adds a function called on every scrape to collect metrics
+func Register(collect func() []Metric) {
+	collectors.Lock()
+	collectors.fs = append(collectors.fs, collect)
+	collectors.Unlock()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Write writes every registered metric to w
+func Write(w io.Writer) error {
+	collectors.Lock()
+	fs := append([]func() []Metric(nil), collectors.fs...)
+	collectors.Unlock()
+
+	for _, collect := range fs {
+		for _, m := range collect() {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type); err != nil {
+				return err
+			}
+			for _, s := range m.Samples {
+				if _, err := fmt.Fprintf(w, "%s%s %g\n", m.Name, formatLabels(s.Labels), s.Value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var names []string
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(labels[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Serve exposes the metrics on http://addr/metrics
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,348 @@
+// Package preflight checks that the host provides what shaping needs, the kernel features, iproute2,
+// the privileges of the daemon, the Docker API and the mounts, before the first container fails on it
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brenozd/tc-docker/pkg/cgroup"
+	"github.com/brenozd/tc-docker/pkg/command"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// NetnsDir is where Docker keeps the network namespaces of containers, the SandboxKey of each one
+const NetnsDir = "/var/run/docker/netns"
+
+// Capabilities of the daemon, as bits of CapEff in /proc/self/status
+const (
+	capNetAdmin = 12
+	capSysAdmin = 21
+)
+
+// Result is the outcome of a check
+type Result struct {
+	Name string
+	OK   bool
+	// Required checks failing prevent shaping any container, the others only some features
+	Required bool
+	Detail   string
+	// Fix tells how to solve a failure
+	Fix string
+}
+
+// Run runs every check, dc is the Docker client the daemon uses
+func Run(ctx context.Context, dc *client.Client) []Result {
+	results := append([]Result{privileges()}, iproute2()...)
+	results = append(results, kernel()...)
+	results = append(results, hostNetwork()...)
+	docker := dockerAPI(ctx, dc)
+	return append(results, docker, netnsMount(ctx, dc, docker.OK))
+}
+
+// Broken returns the failed required checks
+func Broken(results []Result) []Result {
+	var broken []Result
+	for _, r := range results {
+		if r.Required && !r.OK {
+			broken = append(broken, r)
+		}
+	}
+	return broken
+}
+
+// privileges checks the capabilities needed to change qdiscs and enter network namespaces
+func privileges() Result {
+	r := Result{Name: "privileges", Required: true, Fix: "run the daemon with --privileged, or at least --cap-add NET_ADMIN --cap-add SYS_ADMIN"}
+	b, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			r.Detail = err.Error()
+			return r
+		}
+		var missing []string
+		if caps&(1<<capNetAdmin) == 0 {
+			missing = append(missing, "CAP_NET_ADMIN")
+		}
+		if caps&(1<<capSysAdmin) == 0 {
+			missing = append(missing, "CAP_SYS_ADMIN")
+		}
+		if len(missing) > 0 {
+			r.Detail = "missing " + strings.Join(missing, ", ")
+			return r
+		}
+		r.OK = true
+		r.Detail = "CAP_NET_ADMIN, CAP_SYS_ADMIN"
+		return r
+	}
+	r.Detail = "CapEff not found in /proc/self/status"
+	return r
+}
+
+// iproute2Version is a release of iproute2
+type iproute2Version struct {
+	major, minor int
+}
+
+func (v iproute2Version) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+func (v iproute2Version) atLeast(min iproute2Version) bool {
+	return v.major > min.major || v.major == min.major && v.minor >= min.minor
+}
+
+// minIproute2 is the oldest iproute2 shaping works with, the first one with netem slot
+var minIproute2 = iproute2Version{4, 19}
+
+// iproute2Features are the features of labels needing a newer iproute2 than minIproute2
+var iproute2Features = []struct {
+	name    string
+	version iproute2Version
+}{
+	{"pps", iproute2Version{5, 13}},
+	{"loss.seed", iproute2Version{6, 2}},
+}
+
+// iproute2Snapshots are the first snapshots, named by date, of the releases before iproute2 named
+// them by version
+var iproute2Snapshots = []struct {
+	date    int
+	version iproute2Version
+}{
+	{181023, iproute2Version{4, 19}},
+	{190107, iproute2Version{4, 20}},
+	{190319, iproute2Version{5, 0}},
+	{190510, iproute2Version{5, 1}},
+	{190708, iproute2Version{5, 2}},
+	{190924, iproute2Version{5, 3}},
+	{191125, iproute2Version{5, 4}},
+	{200127, iproute2Version{5, 5}},
+	{200330, iproute2Version{5, 6}},
+	{200602, iproute2Version{5, 7}},
+	{200804, iproute2Version{5, 8}},
+}
+
+var iproute2Release = regexp.MustCompile(`iproute2-(ss)?(\d+)(?:\.(\d+))?`)
+
+// parseIproute2Version reads the release of iproute2 from the output of tc -V, either
+// iproute2-<major>.<minor>.<patch> or iproute2-ss<yymmdd> for the older ones
+func parseIproute2Version(out string) (iproute2Version, error) {
+	match := iproute2Release.FindStringSubmatch(out)
+	if match == nil {
+		return iproute2Version{}, fmt.Errorf("no iproute2 release in %q", out)
+	}
+	n, err := strconv.Atoi(match[2])
+	if err != nil {
+		return iproute2Version{}, fmt.Errorf("invalid iproute2 release in %q", out)
+	}
+	if match[1] == "ss" {
+		// Snapshots before the first one known are older than any version shaping works with
+		v := iproute2Version{4, 18}
+		for _, snapshot := range iproute2Snapshots {
+			if n >= snapshot.date {
+				v = snapshot.version
+			}
+		}
+		return v, nil
+	}
+	minor := 0
+	if match[3] != "" {
+		if minor, err = strconv.Atoi(match[3]); err != nil {
+			return iproute2Version{}, fmt.Errorf("invalid iproute2 release in %q", out)
+		}
+	}
+	return iproute2Version{n, minor}, nil
+}
+
+// iproute2 checks that tc and ip are installed and recent enough, and which features of labels their version lacks
+func iproute2() []Result {
+	r := Result{Name: "iproute2", Required: true, Fix: fmt.Sprintf("install iproute2 %s or newer, the image ships it as /usr/sbin/tc and /usr/sbin/ip", minIproute2)}
+	for _, bin := range []string{"/usr/sbin/tc", "/usr/sbin/ip"} {
+		if _, err := os.Stat(bin); err != nil {
+			r.Detail = bin + " not found"
+			return []Result{r}
+		}
+	}
+	out, err := exec.Command("/usr/sbin/tc", "-V").CombinedOutput()
+	if err != nil {
+		r.Detail = fmt.Sprintf("tc -V failed, out: %s, error: %v", oneLine(out), err)
+		return []Result{r}
+	}
+	r.Detail = oneLine(out)
+	v, err := parseIproute2Version(r.Detail)
+	if err != nil {
+		r.Detail = err.Error()
+		return []Result{r}
+	}
+	if !v.atLeast(minIproute2) {
+		r.Detail = fmt.Sprintf("iproute2 %s is older than %s, %s", v, minIproute2, r.Detail)
+		return []Result{r}
+	}
+	r.OK = true
+	results := []Result{r}
+	for _, f := range iproute2Features {
+		feature := Result{Name: "iproute2 " + f.name, OK: v.atLeast(f.version), Detail: fmt.Sprintf("needs iproute2 %s, found %s", f.version, v)}
+		if !feature.OK {
+			feature.Fix = fmt.Sprintf("install iproute2 %s or newer to use the %s labels", f.version, f.name)
+		}
+		results = append(results, feature)
+	}
+	return results
+}
+
+// probe shapes a scratch ifb with a kernel feature, it fails when the kernel lacks the feature
+type probe struct {
+	module string
+	cmds   []string
+	// needs are the modules of the earlier probes this one builds on
+	needs []string
+	// optional modules are only needed by some features
+	optional bool
+}
+
+// kernel shapes a scratch ifb the way containers are shaped, which loads the modules
+// of the features on demand, and reports the ones the kernel lacks
+func kernel() []Result {
+	dev := fmt.Sprintf("tcdprobe%d", os.Getpid()%100000)
+	command.CombinedOutput(fmt.Sprintf("/usr/sbin/ip link del %s", dev))
+	defer command.CombinedOutput(fmt.Sprintf("/usr/sbin/ip link del %s", dev))
+
+	probes := []probe{
+		{module: "ifb", cmds: []string{fmt.Sprintf("/usr/sbin/ip link add name %s type ifb", dev)}},
+		{module: "sch_htb", cmds: []string{
+			fmt.Sprintf("/usr/sbin/tc qdisc add dev %s root handle 1: htb default 2", dev),
+			fmt.Sprintf("/usr/sbin/tc class add dev %s parent 1: classid 1:2 htb rate 1mbit", dev),
+		}, needs: []string{"ifb"}},
+		{module: "sch_netem", cmds: []string{fmt.Sprintf("/usr/sbin/tc qdisc add dev %s parent 1:2 handle 10: netem delay 1ms", dev)}, needs: []string{"sch_htb"}},
+		{module: "cls_matchall", cmds: []string{fmt.Sprintf("/usr/sbin/tc filter add dev %s parent 1: matchall flowid 1:2", dev)}, needs: []string{"sch_htb"}},
+		{module: "sch_ingress", cmds: []string{fmt.Sprintf("/usr/sbin/tc qdisc add dev %s ingress", dev)}, needs: []string{"ifb"}},
+		{module: "act_mirred", cmds: []string{fmt.Sprintf("/usr/sbin/tc filter add dev %s ingress matchall action mirred egress redirect dev %s", dev, dev)}, needs: []string{"cls_matchall", "sch_ingress"}},
+	}
+	if !cgroup.Unified() {
+		// Host network containers are told apart by a cgroup filter on cgroup v1
+		probes = append(probes, probe{module: "cls_cgroup", cmds: []string{fmt.Sprintf("/usr/sbin/tc filter add dev %s parent 1: protocol all prio 1 handle 1: cgroup", dev)}, needs: []string{"sch_htb"}, optional: true})
+	}
+	var results []Result
+	missing := make(map[string]bool)
+probes:
+	for _, p := range probes {
+		r := Result{Name: p.module, Required: !p.optional}
+		for _, need := range p.needs {
+			if missing[need] {
+				missing[p.module] = true
+				r.Detail = "not checked, " + need + " is missing"
+				results = append(results, r)
+				continue probes
+			}
+		}
+		for _, cmd := range p.cmds {
+			if out, err := command.CombinedOutput(cmd); err != nil {
+				missing[p.module] = true
+				r.Detail = fmt.Sprintf("cmd: %s, out: %s, error: %v", cmd, oneLine(out), err)
+				r.Fix = fmt.Sprintf("load the module on the host with modprobe %s, or use a kernel built with it", p.module)
+				results = append(results, r)
+				continue probes
+			}
+		}
+		r.OK = true
+		results = append(results, r)
+	}
+	return results
+}
+
+// hostNetwork checks what shaping containers sharing the host network needs besides cls_cgroup,
+// the cgroup version of the host and with v1 the net_cls hierarchy, with v2 loading BPF programs
+func hostNetwork() []Result {
+	if cgroup.Unified() {
+		r := Result{Name: "cgroup", OK: true, Detail: "v2, host network containers are classified by a BPF program"}
+		classifier := Result{Name: "cgroup_skb", Fix: "use a kernel with CONFIG_CGROUP_BPF, needed to shape host network containers on cgroup v2"}
+		if err := cgroup.ProbeClassify(); err != nil {
+			classifier.Detail = err.Error()
+		} else {
+			classifier.OK = true
+		}
+		return []Result{r, classifier}
+	}
+	r := Result{Name: "cgroup", Detail: "v1, host network containers are classified with net_cls", Fix: "mount the net_cls hierarchy of the host, -v /sys/fs/cgroup:/sys/fs/cgroup, to shape host network containers"}
+	if _, err := os.Stat(filepath.Join(cgroup.Root, "net_cls")); err == nil {
+		r.OK = true
+	} else {
+		r.Detail += ", " + filepath.Join(cgroup.Root, "net_cls") + " not found"
+	}
+	return []Result{r}
+}
+
+// dockerAPI checks that the Docker API answers
+func dockerAPI(ctx context.Context, dc *client.Client) Result {
+	r := Result{Name: "docker", Required: true, Fix: "mount the Docker socket, -v /var/run/docker.sock:/var/run/docker.sock, or set DOCKER_HOST and DOCKER_API_VERSION"}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	v, err := dc.ServerVersion(ctx)
+	if err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+	r.OK = true
+	r.Detail = fmt.Sprintf("Docker %s, API %s", v.Version, dc.ClientVersion())
+	return r
+}
+
+// netnsMount checks that the network namespaces of the running containers can be opened, which
+// needs the netns directory of Docker mounted with rslave propagation so new namespaces show up.
+// Without the Docker API only the directory is checked.
+func netnsMount(ctx context.Context, dc *client.Client, docker bool) Result {
+	r := Result{Name: "netns", Required: true, Fix: fmt.Sprintf("mount it, -v %s:%s:rslave", NetnsDir, NetnsDir)}
+	if _, err := os.Stat(NetnsDir); err != nil {
+		r.Detail = NetnsDir + " not found"
+		return r
+	}
+	if !docker {
+		r.OK = true
+		r.Detail = NetnsDir + " mounted, namespaces not checked without the Docker API"
+		return r
+	}
+	containers, err := dc.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		r.Detail = fmt.Sprintf("ContainerList error: %v", err)
+		return r
+	}
+	for _, c := range containers {
+		cJson, err := dc.ContainerInspect(ctx, c.ID)
+		if err != nil || cJson.NetworkSettings == nil || cJson.NetworkSettings.SandboxKey == "" {
+			continue
+		}
+		if _, err := os.Stat(cJson.NetworkSettings.SandboxKey); err != nil {
+			r.Detail = fmt.Sprintf("network namespace of %s not visible, %v", strings.TrimLeft(cJson.Name, "/"), err)
+			return r
+		}
+		r.OK = true
+		r.Detail = fmt.Sprintf("%s mounted, network namespace of %s visible", NetnsDir, strings.TrimLeft(cJson.Name, "/"))
+		return r
+	}
+	r.OK = true
+	r.Detail = NetnsDir + " mounted, no running container to check it with"
+	return r
+}
+
+// oneLine joins the lines of a command output
+func oneLine(out []byte) string {
+	return strings.Join(strings.Fields(string(out)), " ")
+}
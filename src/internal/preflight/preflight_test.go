@@ -0,0 +1,46 @@
+package preflight
+
+import "testing"
+
+func TestParseIproute2Version(t *testing.T) {
+	tests := []struct {
+		out     string
+		version iproute2Version
+		ok      bool
+	}{
+		{"tc utility, iproute2-6.1.0, libbpf 1.1.2", iproute2Version{6, 1}, true},
+		{"tc utility, iproute2-5.13.0", iproute2Version{5, 13}, true},
+		{"tc utility, iproute2-v6.2", iproute2Version{}, false},
+		{"tc utility, iproute2-ss190107", iproute2Version{4, 20}, true},
+		{"tc utility, iproute2-ss200602", iproute2Version{5, 7}, true},
+		{"tc utility, iproute2-ss170501", iproute2Version{4, 18}, true},
+		{"tc utility", iproute2Version{}, false},
+	}
+	for _, tt := range tests {
+		v, err := parseIproute2Version(tt.out)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseIproute2Version(%q) error = %v, want ok %v", tt.out, err, tt.ok)
+			continue
+		}
+		if tt.ok && v != tt.version {
+			t.Errorf("parseIproute2Version(%q) = %s, want %s", tt.out, v, tt.version)
+		}
+	}
+}
+
+func TestIproute2VersionAtLeast(t *testing.T) {
+	tests := []struct {
+		v, min iproute2Version
+		want   bool
+	}{
+		{iproute2Version{4, 19}, minIproute2, true},
+		{iproute2Version{4, 18}, minIproute2, false},
+		{iproute2Version{5, 0}, minIproute2, true},
+		{iproute2Version{6, 1}, iproute2Version{6, 2}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.v.atLeast(tt.min); got != tt.want {
+			t.Errorf("%s.atLeast(%s) = %v, want %v", tt.v, tt.min, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package tc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+const (
+	defaultPriority = 4
+	defaultWeight   = 1
+	// lowestPriority is used for traffic of containers that didn't ask for any priority
+	lowestPriority = 7
+	// firstBridgeMinor is the class minor, and filter preference, of the first member of a bridge
+	firstBridgeMinor = 0x10
+	// mtuQuantum is the quantum given to each unit of weight
+	mtuQuantum = 1514
+	maxQuantum = 200000
+)
+
+// A bridge arbitrates the traffic of every prioritized container attached to a docker bridge.
+// Traffic sent to containers is shaped on the bridge root HTB, traffic coming from containers
+// is redirected from the bridge ingress to an ifb holding the same tree. Only traffic crossing
+// the bridge device, to and from the host and other networks, goes through them, traffic between
+// containers of the bridge is switched from veth to veth and isn't prioritized. Class 1:1 carries the
+// bridge capacity, 1:2 is the default class for everything else and each member gets a class
+// with its priority, a guaranteed rate proportional to its weight and the whole bridge as ceil.
+type bridge struct {
+	dev     string
+	ifb     string
+	limit   global.Limit
+	members map[string]*bridgeMember
+}
+
+type bridgeMember struct {
+	id       string
+	ip       string
+	minor    int
+	priority int
+	weight   int
+}
+
+var bridges = struct {
+	sync.Mutex
+	m map[string]*bridge
+}{m: make(map[string]*bridge)}
+
+func parsePriority(container *docker.Container) (int, int, error) {
+	priority, weight := defaultPriority, defaultWeight
+	var err error
+	if container.Priority != "" {
+		priority, err = strconv.Atoi(container.Priority)
+		if err != nil || priority < 0 || priority > lowestPriority {
+			return 0, 0, fmt.Errorf("invalid priority %q, must be between 0 and %d", container.Priority, lowestPriority)
+		}
+	}
+	if container.Weight != "" {
+		weight, err = strconv.Atoi(container.Weight)
+		if err != nil || weight < 1 {
+			return 0, 0, fmt.Errorf("invalid weight %q, must be a positive integer", container.Weight)
+		}
+	}
+	return priority, weight, nil
+}
+
+// joinBridges adds the container to the tree of every bridge network it is attached to
+func joinBridges(container *docker.Container) error {
+	if container.Priority == "" && container.Weight == "" {
+		return nil
+	}
+	priority, weight, err := parsePriority(container)
+	if err != nil {
+		return err
+	}
+
+	bridges.Lock()
+	defer bridges.Unlock()
+
+	for _, network := range container.Networks {
+		if network.Bridge == "" || network.IP == "" {
+			continue
+		}
+		b, err := getBridge(network.Bridge)
+		if err != nil {
+			return err
+		}
+		key := memberKey(container.ID, network.Bridge)
+		if _, exists := b.members[key]; exists {
+			continue
+		}
+		m := &bridgeMember{id: container.ID, ip: network.IP, minor: b.freeMinor(), priority: priority, weight: weight}
+		b.members[key] = m
+
+		for _, d := range []struct{ dev, match string }{{b.dev, "dst"}, {b.ifb, "src"}} {
+			cmd := fmt.Sprintf("/usr/sbin/tc class add dev %s parent 1:1 classid 1:%x htb rate 1bit", d.dev, m.minor)
+			if err := run(cmd); err != nil {
+				return err
+			}
+			// The filter preference is the member class so it can be deleted without knowing its handle
+			cmd = fmt.Sprintf("/usr/sbin/tc filter add dev %s parent 1: protocol ip pref %d u32 match ip %s %s/32 flowid 1:%x", d.dev, m.minor, d.match, m.ip, m.minor)
+			if err := run(cmd); err != nil {
+				return err
+			}
+		}
+		if err := b.rebalance(); err != nil {
+			return err
+		}
+		glog.Debugf("joinBridges, bridge: %s, container: %s, ip: %s, class: 1:%x, priority: %d, weight: %d", b.dev, container.Name, m.ip, m.minor, priority, weight)
+	}
+	return nil
+}
+
+// freeMinor returns the lowest class minor no member holds, must be called with bridges locked
+func (b *bridge) freeMinor() int {
+	used := make(map[int]bool)
+	for _, m := range b.members {
+		used[m.minor] = true
+	}
+	return lowestUnused(firstBridgeMinor, used)
+}
+
+// LeaveBridges removes the container classes from every bridge tree and shares
+// its guaranteed rate among the remaining members
+func LeaveBridges(id string) error {
+	bridges.Lock()
+	defer bridges.Unlock()
+
+	for _, b := range bridges.m {
+		removed := false
+		for key, m := range b.members {
+			if m.id != id {
+				continue
+			}
+			for _, dev := range []string{b.dev, b.ifb} {
+				cmd := fmt.Sprintf("/usr/sbin/tc filter del dev %s parent 1: pref %d", dev, m.minor)
+				if err := run(cmd); err != nil {
+					glog.Errorf("LeaveBridges, bridge: %s, error: %v", b.dev, err)
+				}
+				cmd = fmt.Sprintf("/usr/sbin/tc class del dev %s classid 1:%x", dev, m.minor)
+				if err := run(cmd); err != nil {
+					glog.Errorf("LeaveBridges, bridge: %s, error: %v", b.dev, err)
+				}
+			}
+			delete(b.members, key)
+			removed = true
+		}
+		if removed {
+			if err := b.rebalance(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prioritizedOn returns the bridges the container is prioritized on, sorted
+func prioritizedOn(id string) []string {
+	bridges.Lock()
+	defer bridges.Unlock()
+	var devs []string
+	for _, b := range bridges.m {
+		for _, m := range b.members {
+			if m.id == id {
+				devs = append(devs, b.dev)
+				break
+			}
+		}
+	}
+	sort.Strings(devs)
+	return devs
+}
+
+// getBridge returns the tree of the bridge device, building it the first time it is used.
+// Must be called with bridges locked.
+func getBridge(dev string) (*bridge, error) {
+	if b, ok := bridges.m[dev]; ok {
+		return b, nil
+	}
+	limit, ok := global.Conf.Bridges[dev]
+	if !ok {
+		limit = global.Limit{Rate: docker.DefaultRate}
+	}
+	if limit.Ceil == "" {
+		limit.Ceil = limit.Rate
+	}
+	var err error
+	if limit.Rate, err = resolveRate(limit.Rate, hostReference); err != nil {
+		return nil, err
+	}
+	if limit.Ceil, err = resolveRate(limit.Ceil, hostReference); err != nil {
+		return nil, err
+	}
+	b := &bridge{
+		dev:     dev,
+		ifb:     hashedIfbName(dev, "b"),
+		limit:   limit,
+		members: make(map[string]*bridgeMember),
+	}
+
+	if err := run(fmt.Sprintf("/usr/sbin/ip link show dev %s", b.ifb)); err != nil {
+		if err := run(fmt.Sprintf("/usr/sbin/ip link add name %s type ifb", b.ifb)); err != nil {
+			return nil, err
+		}
+	}
+	if err := run(fmt.Sprintf("/usr/sbin/ip link set dev %s up", b.ifb)); err != nil {
+		return nil, err
+	}
+	if err := replaceQdisc("", b.dev, "root", "1:", "htb default 2"); err != nil {
+		return nil, err
+	}
+	if err := installQdisc("", b.ifb, "root", "1:", "htb default 2"); err != nil {
+		return nil, err
+	}
+	for _, dev := range []string{b.dev, b.ifb} {
+		if err := run(fmt.Sprintf("/usr/sbin/tc class add dev %s parent 1: classid 1:1 htb rate %s ceil %s", dev, limit.Rate, limit.Ceil)); err != nil {
+			return nil, err
+		}
+		if err := run(fmt.Sprintf("/usr/sbin/tc class add dev %s parent 1:1 classid 1:2 htb rate %s ceil %s prio %d", dev, limit.Rate, limit.Ceil, lowestPriority)); err != nil {
+			return nil, err
+		}
+	}
+	if err := replaceQdisc("", b.dev, "ingress", "ffff:", ""); err != nil {
+		return nil, err
+	}
+	if err := run(fmt.Sprintf("/usr/sbin/tc filter add dev %s ingress matchall action mirred egress redirect dev %s", b.dev, b.ifb)); err != nil {
+		return nil, err
+	}
+
+	bridges.m[dev] = b
+	glog.Infof("Bridge %s prioritization ready, rate: %s, ceil: %s, ifb: %s", dev, limit.Rate, limit.Ceil, b.ifb)
+	return b, nil
+}
+
+// rebalance gives every class a guaranteed rate proportional to its weight,
+// unprioritized traffic in 1:2 counts as a single default weight.
+// Must be called with bridges locked.
+func (b *bridge) rebalance() error {
+	total, err := parseRate(b.limit.Rate)
+	if err != nil {
+		return fmt.Errorf("bridge %s: %v", b.dev, err)
+	}
+	weights := defaultWeight
+	for _, m := range b.members {
+		weights += m.weight
+	}
+	share := func(weight int) string {
+		return formatRate(total * uint64(weight) / uint64(weights))
+	}
+	quantum := func(weight int) int {
+		if weight*mtuQuantum > maxQuantum {
+			return maxQuantum
+		}
+		return weight * mtuQuantum
+	}
+
+	for _, dev := range []string{b.dev, b.ifb} {
+		cmd := fmt.Sprintf("/usr/sbin/tc class change dev %s parent 1:1 classid 1:2 htb rate %s ceil %s prio %d quantum %d",
+			dev, share(defaultWeight), b.limit.Ceil, lowestPriority, quantum(defaultWeight))
+		if err := run(cmd); err != nil {
+			return err
+		}
+		for _, m := range b.members {
+			cmd := fmt.Sprintf("/usr/sbin/tc class change dev %s parent 1:1 classid 1:%x htb rate %s ceil %s prio %d quantum %d",
+				dev, m.minor, share(m.weight), b.limit.Ceil, m.priority, quantum(m.weight))
+			if err := run(cmd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
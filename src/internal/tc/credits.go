@@ -0,0 +1,246 @@
+package tc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/docker"
+	"github.com/brenozd/tc-docker/internal/metrics"
+)
+
+// creditRestore is the part of its maximum balance an exhausted direction must earn back
+// before bursting again, so it doesn't flap between baseline and ceil on every check
+const creditRestore = 0.1
+
+// creditLimits is a parsed docker.Credits, indexed by direction, upload first.
+// A direction without baseline doesn't use credits.
+type creditLimits struct {
+	baseline     [2]uint64
+	baselineRate [2]string
+	max          [2]uint64
+}
+
+// creditBalance holds the credits, in bytes, of each direction of a managed veth
+type creditBalance struct {
+	balance   [2]float64
+	exhausted [2]bool
+	// applied is the exhaustion in force on the classes
+	applied [2]bool
+	updated time.Time
+}
+
+var creditBalances = struct {
+	sync.Mutex
+	m map[string]*creditBalance
+}{m: make(map[string]*creditBalance)}
+
+func parseCredits(c docker.Credits) (creditLimits, error) {
+	var limits creditLimits
+	for i, d := range []struct{ direction, baseline, max string }{
+		{"upload", c.UploadBaseline, c.UploadMax},
+		{"download", c.DownloadBaseline, c.DownloadMax},
+	} {
+		if d.baseline == "" && d.max == "" {
+			continue
+		}
+		if d.baseline == "" || d.max == "" {
+			return limits, fmt.Errorf("%s credits require both baseline and max", d.direction)
+		}
+		baseline, err := parseRate(d.baseline)
+		if err != nil || baseline == 0 {
+			return limits, fmt.Errorf("invalid %s credits baseline %q", d.direction, d.baseline)
+		}
+		max, err := parseSize(d.max)
+		if err != nil || max == 0 {
+			return limits, fmt.Errorf("invalid %s credits max %q", d.direction, d.max)
+		}
+		limits.baseline[i], limits.baselineRate[i], limits.max[i] = baseline, d.baseline, max
+	}
+	return limits, nil
+}
+
+// getBalance returns the credits of a veth, veths start with a full balance at now.
+// Must be called with creditBalances locked.
+func getBalance(key string, limits creditLimits, now time.Time) *creditBalance {
+	b, ok := creditBalances.m[key]
+	if !ok {
+		b = &creditBalance{updated: now}
+		for i := range limits.max {
+			b.balance[i] = float64(limits.max[i])
+		}
+		creditBalances.m[key] = b
+	}
+	return b
+}
+
+// applyCredits limits the directions that ran out of credits to their baseline
+func applyCredits(container *docker.Container) error {
+	if container.Credits == (docker.Credits{}) {
+		return nil
+	}
+	limits, err := parseCredits(container.Credits)
+	if err != nil {
+		return err
+	}
+	creditBalances.Lock()
+	b := getBalance(memberKey(container.ID, container.Veth), limits, time.Now())
+	b.applied = b.exhausted
+	exhausted := b.exhausted
+	creditBalances.Unlock()
+	if exhausted[0] {
+		overrideLimit(&container.UploadRate, &container.UploadCeil, global.Limit{Rate: limits.baselineRate[0]})
+	}
+	if exhausted[1] {
+		overrideLimit(&container.DownloadRate, &container.DownloadCeil, global.Limit{Rate: limits.baselineRate[1]})
+	}
+	return nil
+}
+
+// spendCredits earns the baseline worth of credits since the last update and spends the traffic
+// sent meanwhile, it returns whether the exhaustion of a direction changed from the one applied
+func spendCredits(key string, limits creditLimits, sent [2]uint64, now time.Time) bool {
+	creditBalances.Lock()
+	defer creditBalances.Unlock()
+	b := getBalance(key, limits, now)
+	elapsed := now.Sub(b.updated).Seconds()
+	b.updated = now
+	for i := range limits.baseline {
+		if limits.baseline[i] == 0 {
+			continue
+		}
+		b.balance[i] += float64(limits.baseline[i])/8*elapsed - float64(sent[i])
+		if b.balance[i] < 0 {
+			b.balance[i] = 0
+		}
+		if max := float64(limits.max[i]); b.balance[i] > max {
+			b.balance[i] = max
+		}
+		if !b.exhausted[i] && b.balance[i] == 0 {
+			b.exhausted[i] = true
+		} else if b.exhausted[i] && b.balance[i] >= creditRestore*float64(limits.max[i]) {
+			b.exhausted[i] = false
+		}
+	}
+	return b.exhausted != b.applied
+}
+
+// forgetCredits drops the balances of the container
+func forgetCredits(id string) {
+	creditBalances.Lock()
+	defer creditBalances.Unlock()
+	for key := range creditBalances.m {
+		if strings.HasPrefix(key, id+"/") {
+			delete(creditBalances.m, key)
+		}
+	}
+}
+
+// WatchCredits updates the credit balances of the containers every interval from their class
+// statistics and changes their rates in place when a direction runs out of credits or earns them back
+func WatchCredits(interval time.Duration) {
+	for wait(interval) {
+		for _, container := range managedContainers(func(c *docker.Container) bool { return c.Credits != (docker.Credits{}) }) {
+			limits, err := parseCredits(container.Credits)
+			if err != nil {
+				continue
+			}
+			sent, err := trafficDelta("credits", container)
+			if err != nil {
+				glog.Errorf("Credits accounting failed, container: %s, veth: %s, error: %v", container.Name, container.Veth, err)
+				continue
+			}
+			if !spendCredits(memberKey(container.ID, container.Veth), limits, sent, time.Now()) {
+				continue
+			}
+			glog.Infof("Credits changed, container: %s, veth: %s%s", container.Name, container.Veth, getCreditStatusString(getCreditStatus(container)))
+			if err := updateRates(*container); err != nil {
+				glog.Errorf("updateRates failed, container: %s, id: %s, error: %v", container.Name, container.ID, err)
+			}
+		}
+	}
+}
+
+// CreditStatus is the credit balance of each direction of a veth, in bytes
+type CreditStatus struct {
+	Upload            uint64 `json:"upload"`
+	UploadMax         uint64 `json:"uploadMax,omitempty"`
+	UploadExhausted   bool   `json:"uploadExhausted"`
+	Download          uint64 `json:"download"`
+	DownloadMax       uint64 `json:"downloadMax,omitempty"`
+	DownloadExhausted bool   `json:"downloadExhausted"`
+}
+
+// getCreditStatus returns the credits of the container, nil when it doesn't use valid credits
+func getCreditStatus(container *docker.Container) *CreditStatus {
+	if container.Credits == (docker.Credits{}) {
+		return nil
+	}
+	limits, err := parseCredits(container.Credits)
+	if err != nil {
+		return nil
+	}
+	creditBalances.Lock()
+	defer creditBalances.Unlock()
+	b := getBalance(memberKey(container.ID, container.Veth), limits, time.Now())
+	return &CreditStatus{
+		Upload:            uint64(b.balance[0]),
+		UploadMax:         limits.max[0],
+		UploadExhausted:   b.exhausted[0],
+		Download:          uint64(b.balance[1]),
+		DownloadMax:       limits.max[1],
+		DownloadExhausted: b.exhausted[1],
+	}
+}
+
+func getCreditStatusString(s *CreditStatus) string {
+	var creditString string
+	if s.UploadMax > 0 {
+		creditString += fmt.Sprintf(", upload credits: %d/%d bytes, exhausted: %t", s.Upload, s.UploadMax, s.UploadExhausted)
+	}
+	if s.DownloadMax > 0 {
+		creditString += fmt.Sprintf(", download credits: %d/%d bytes, exhausted: %t", s.Download, s.DownloadMax, s.DownloadExhausted)
+	}
+	return creditString
+}
+
+// creditMetrics collects the credit balances of every managed veth using credits
+func creditMetrics() []metrics.Metric {
+	balance := metrics.Metric{Name: "tc_docker_credit_balance_bytes", Help: "Credits left to burst above the baseline rate.", Type: "gauge"}
+	exhausted := metrics.Metric{Name: "tc_docker_credit_exhausted", Help: "Whether the container is limited to its baseline rate.", Type: "gauge"}
+	containers := managedContainers(func(c *docker.Container) bool { return c.Credits != (docker.Credits{}) })
+	sort.Slice(containers, func(i, j int) bool {
+		return memberKey(containers[i].Name, containers[i].Veth) < memberKey(containers[j].Name, containers[j].Veth)
+	})
+	for _, container := range containers {
+		status := getCreditStatus(container)
+		if status == nil {
+			continue
+		}
+		for _, d := range []struct {
+			direction string
+			balance   uint64
+			max       uint64
+			exhausted bool
+		}{
+			{"upload", status.Upload, status.UploadMax, status.UploadExhausted},
+			{"download", status.Download, status.DownloadMax, status.DownloadExhausted},
+		} {
+			if d.max == 0 {
+				continue
+			}
+			labels := map[string]string{"container": container.Name, "veth": container.Veth, "direction": d.direction}
+			balance.Samples = append(balance.Samples, metrics.Sample{Labels: labels, Value: float64(d.balance)})
+			value := 0.0
+			if d.exhausted {
+				value = 1
+			}
+			exhausted.Samples = append(exhausted.Samples, metrics.Sample{Labels: labels, Value: value})
+		}
+	}
+	return []metrics.Metric{balance, exhausted}
+}
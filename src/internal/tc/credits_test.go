@@ -0,0 +1,75 @@
+package tc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+func TestParseCredits(t *testing.T) {
+	tests := []struct {
+		credits docker.Credits
+		want    creditLimits
+		ok      bool
+	}{
+		{docker.Credits{}, creditLimits{}, true},
+		{docker.Credits{UploadBaseline: "8mbit", UploadMax: "10MB"}, creditLimits{baseline: [2]uint64{8e6, 0}, baselineRate: [2]string{"8mbit", ""}, max: [2]uint64{10e6, 0}}, true},
+		{docker.Credits{DownloadBaseline: "1mbit", DownloadMax: "1GiB"}, creditLimits{baseline: [2]uint64{0, 1e6}, baselineRate: [2]string{"", "1mbit"}, max: [2]uint64{0, 1 << 30}}, true},
+		{docker.Credits{UploadBaseline: "8mbit"}, creditLimits{}, false},
+		{docker.Credits{DownloadMax: "10MB"}, creditLimits{}, false},
+		{docker.Credits{UploadBaseline: "10%", UploadMax: "10MB"}, creditLimits{}, false},
+		{docker.Credits{UploadBaseline: "8mbit", UploadMax: "0"}, creditLimits{}, false},
+	}
+	for _, tt := range tests {
+		limits, err := parseCredits(tt.credits)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseCredits(%+v) error = %v, want ok %t", tt.credits, err, tt.ok)
+			continue
+		}
+		if tt.ok && limits != tt.want {
+			t.Errorf("parseCredits(%+v) = %+v, want %+v", tt.credits, limits, tt.want)
+		}
+	}
+}
+
+func TestSpendCredits(t *testing.T) {
+	// Upload earns 1MB per second up to 10MB, download has no credits
+	limits := creditLimits{baseline: [2]uint64{8e6, 0}, baselineRate: [2]string{"8mbit", ""}, max: [2]uint64{10e6, 0}}
+	key := memberKey("test", "veth0")
+	defer forgetCredits("test")
+	start := time.Now()
+	steps := []struct {
+		after     time.Duration
+		sent      [2]uint64
+		balance   float64
+		exhausted bool
+		changed   bool
+		// apply records the exhaustion as applied on the classes, like applyCredits does
+		apply bool
+	}{
+		{0, [2]uint64{0, 0}, 10e6, false, false, false},
+		{time.Second, [2]uint64{5e6, 1e9}, 6e6, false, false, false},
+		{2 * time.Second, [2]uint64{20e6, 0}, 0, true, true, true},
+		{2500 * time.Millisecond, [2]uint64{0, 0}, 0.5e6, true, false, false},
+		{3 * time.Second, [2]uint64{0, 0}, 1e6, false, true, true},
+		{time.Minute, [2]uint64{0, 0}, 10e6, false, false, false},
+	}
+	for i, step := range steps {
+		changed := spendCredits(key, limits, step.sent, start.Add(step.after))
+		creditBalances.Lock()
+		b := creditBalances.m[key]
+		if step.apply {
+			b.applied = b.exhausted
+		}
+		balance, exhausted := b.balance[0], b.exhausted[0]
+		download := b.balance[1]
+		creditBalances.Unlock()
+		if balance != step.balance || exhausted != step.exhausted || changed != step.changed {
+			t.Errorf("step %d: balance, exhausted, changed = %g, %t, %t, want %g, %t, %t", i, balance, exhausted, changed, step.balance, step.exhausted, step.changed)
+		}
+		if download != 0 {
+			t.Errorf("step %d: download balance = %g, want 0", i, download)
+		}
+	}
+}
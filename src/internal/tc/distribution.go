@@ -0,0 +1,78 @@
+package tc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/pkg/distribution"
+)
+
+var distributionName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// distributions keeps the tables generated from samples so their mean and
+// standard deviation can be used as default delay and variation
+var distributions = struct {
+	sync.Mutex
+	m map[string]*distribution.Table
+}{m: make(map[string]*distribution.Table)}
+
+// GenerateDistributions builds a netem distribution table for every samples file in the
+// config and stores it where tc looks for distributions, overwriting previous versions
+func GenerateDistributions() error {
+	for name, samplesFile := range global.Conf.Distributions {
+		if !distributionName.MatchString(name) {
+			return fmt.Errorf("invalid distribution name %q", name)
+		}
+		table, err := makeDistribution(samplesFile)
+		if err != nil {
+			return fmt.Errorf("distribution %s: %v", name, err)
+		}
+		tableFile := filepath.Join(global.Conf.DistributionDir, name+".dist")
+		f, err := os.Create(tableFile)
+		if err != nil {
+			return fmt.Errorf("distribution %s: %v", name, err)
+		}
+		err = table.Write(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("distribution %s: %v", name, err)
+		}
+		distributions.Lock()
+		distributions.m[name] = table
+		distributions.Unlock()
+		glog.Infof("Distribution %s generated from %s, mean: %.3fms, stddev: %.3fms, table: %s", name, samplesFile, table.Mean, table.Stddev, tableFile)
+	}
+	return nil
+}
+
+func makeDistribution(samplesFile string) (*distribution.Table, error) {
+	f, err := os.Open(samplesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	samples, err := distribution.ReadSamples(f)
+	if err != nil {
+		return nil, err
+	}
+	return distribution.Make(samples)
+}
+
+// getDistribution checks that tc can find the named distribution and returns
+// its table when it was generated from samples
+func getDistribution(name string) (*distribution.Table, error) {
+	if !distributionName.MatchString(name) {
+		return nil, fmt.Errorf("invalid distribution name %q", name)
+	}
+	if _, err := os.Stat(filepath.Join(global.Conf.DistributionDir, name+".dist")); err != nil {
+		return nil, fmt.Errorf("distribution %s not found in %s", name, global.Conf.DistributionDir)
+	}
+	distributions.Lock()
+	defer distributions.Unlock()
+	return distributions.m[name], nil
+}
@@ -0,0 +1,217 @@
+package tc
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/docker"
+	"github.com/brenozd/tc-docker/pkg/cgroup"
+)
+
+// Containers sharing the host network have no interface of their own, their egress traffic
+// is told apart by cgroup on the host uplink instead. The uplink root HTB has no default
+// class so the host traffic is sent untouched, every member gets a class 1:<minor> with
+// its upload limits and netem below it. On cgroup v1 the member cgroup gets the class as
+// its net_cls.classid, read by a cgroup filter. On cgroup v2 a BPF program attached to the
+// member cgroup sets the class as the priority of the packets it sends on the uplink.
+// Download isn't shaped, there is no device to shape it on. The HTB replaces the root qdisc
+// of the uplink, e.g. mq, for all of the host traffic, the root replaced is put back once
+// the last member leaves and when the daemon stops.
+type uplink struct {
+	dev     string
+	index   int
+	unified bool
+	members map[string]*uplinkMember
+}
+
+type uplinkMember struct {
+	id     string
+	name   string
+	cgroup string
+	minor  int
+}
+
+// firstUplinkMinor is the class minor of the first member on the uplink
+const firstUplinkMinor = 0x10
+
+var uplinks = struct {
+	sync.Mutex
+	u *uplink
+}{}
+
+// uplinkDevice returns the configured uplink, the interface of the default route otherwise
+func uplinkDevice() (string, error) {
+	if global.Conf.Uplink != "" {
+		return global.Conf.Uplink, nil
+	}
+	dev, err := defaultRouteInterface()
+	if err != nil {
+		return "", fmt.Errorf("cannot find the uplink of host network containers, set uplink in config: %v", err)
+	}
+	return dev, nil
+}
+
+// getUplink returns the uplink, setting up its root qdisc the first time it is used.
+// Must be called with uplinks locked.
+func getUplink() (*uplink, error) {
+	if uplinks.u != nil {
+		return uplinks.u, nil
+	}
+	dev, err := uplinkDevice()
+	if err != nil {
+		return nil, err
+	}
+	iface, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil, fmt.Errorf("uplink %s: %v", dev, err)
+	}
+	u := &uplink{dev: dev, index: iface.Index, unified: cgroup.Unified(), members: make(map[string]*uplinkMember)}
+	if err := replaceQdisc("", dev, "root", "1:", "htb"); err != nil {
+		return nil, err
+	}
+	if !u.unified {
+		// The root may be the one of an earlier run, adopted with its filter
+		if err := run(fmt.Sprintf("/usr/sbin/tc filter replace dev %s parent 1: protocol all prio 1 handle 1: cgroup", dev)); err != nil {
+			return nil, err
+		}
+	}
+	uplinks.u = u
+	glog.Infof("Uplink %s ready for host network containers, cgroup v2: %t", dev, u.unified)
+	return u, nil
+}
+
+// joinUplink shapes the egress traffic of a host network container on the uplink
+func joinUplink(container *docker.Container) error {
+	uplinks.Lock()
+	defer uplinks.Unlock()
+
+	u, err := getUplink()
+	if err != nil {
+		return err
+	}
+	m, exists := u.members[container.ID]
+	if !exists {
+		m = &uplinkMember{id: container.ID, name: container.Name, minor: u.freeMinor()}
+	}
+	previous := m.cgroup
+	m.cgroup = container.Cgroup
+	u.members[container.ID] = m
+
+	verb := "add"
+	if exists {
+		verb = "change"
+	}
+	if err := u.setClass(verb, m, container); err != nil {
+		return err
+	}
+	netemFlags, err := getNetemFlags(container)
+	if err != nil {
+		return err
+	}
+	if err := run(fmt.Sprintf("/usr/sbin/tc qdisc replace dev %s parent 1:%x handle %x: netem %s", u.dev, m.minor, m.minor, netemFlags)); err != nil {
+		return err
+	}
+
+	if u.unified {
+		if err := cgroup.Classify(m.cgroup, u.index, 0x10000|uint32(m.minor)); err != nil {
+			return err
+		}
+		if exists && previous != m.cgroup {
+			unclassify(previous)
+		}
+	} else if err := cgroup.SetClassID(m.cgroup, 0x10000|uint32(m.minor)); err != nil {
+		return err
+	}
+	glog.Debugf("joinUplink, uplink: %s, container: %s, cgroup: %s, class: 1:%x", u.dev, container.Name, m.cgroup, m.minor)
+	return nil
+}
+
+// freeMinor returns the lowest class minor no member holds, must be called with uplinks locked
+func (u *uplink) freeMinor() int {
+	used := make(map[int]bool)
+	for _, m := range u.members {
+		used[m.minor] = true
+	}
+	return lowestUnused(firstUplinkMinor, used)
+}
+
+// setClass sets the upload limits of the container on its class, verb is either add or change.
+// Must be called with uplinks locked.
+func (u *uplink) setClass(verb string, m *uplinkMember, container *docker.Container) error {
+	params, err := htbClassParams(container.UploadRate, container.UploadCeil, container.UploadTuning, deviceMTU(u.dev))
+	if err != nil {
+		return fmt.Errorf("upload: %v", err)
+	}
+	return run(fmt.Sprintf("/usr/sbin/tc class %s dev %s parent 1: classid 1:%x htb rate %s ceil %s %s", verb, u.dev, m.minor, container.UploadRate, container.UploadCeil, params))
+}
+
+// unclassify detaches the classifier of a cgroup v2, it is gone already when the container died
+func unclassify(path string) {
+	if err := cgroup.Unclassify(path); err != nil {
+		glog.Warnf("Detaching classifier failed, cgroup: %s, error: %v", path, err)
+	}
+}
+
+// updateUplinkRates changes the class of a host network container in place
+func updateUplinkRates(container *docker.Container) error {
+	uplinks.Lock()
+	defer uplinks.Unlock()
+	if uplinks.u == nil || uplinks.u.members[container.ID] == nil {
+		return fmt.Errorf("container %s is not shaped on the uplink", container.Name)
+	}
+	return uplinks.u.setClass("change", uplinks.u.members[container.ID], container)
+}
+
+// uplinkClass returns the uplink and the class carrying the traffic of a host network container
+func uplinkClass(id string) (string, string, bool) {
+	uplinks.Lock()
+	defer uplinks.Unlock()
+	if uplinks.u == nil || uplinks.u.members[id] == nil {
+		return "", "", false
+	}
+	return uplinks.u.dev, fmt.Sprintf("1:%x", uplinks.u.members[id].minor), true
+}
+
+// leaveUplink deletes the class of a host network container and stops classifying its traffic
+func leaveUplink(id string) error {
+	uplinks.Lock()
+	defer uplinks.Unlock()
+	u := uplinks.u
+	if u == nil || u.members[id] == nil {
+		return nil
+	}
+	m := u.members[id]
+	delete(u.members, id)
+	if u.unified {
+		unclassify(m.cgroup)
+	}
+	glog.Debugf("leaveUplink, uplink: %s, container: %s, remaining members: %d", u.dev, m.name, len(u.members))
+	if len(u.members) == 0 {
+		// The host traffic gets its own root qdisc back once no container is shaped on the uplink
+		uplinks.u = nil
+		glog.Infof("Uplink %s has no host network container left, restoring its root qdisc", u.dev)
+		return restoreQdisc(u.dev)
+	}
+	return run(fmt.Sprintf("/usr/sbin/tc class del dev %s classid 1:%x", u.dev, m.minor))
+}
+
+// ReleaseUplink puts back the root qdisc the uplink had before host network containers were shaped on it,
+// the daemon calls it when it stops
+func ReleaseUplink() error {
+	uplinks.Lock()
+	defer uplinks.Unlock()
+	u := uplinks.u
+	if u == nil {
+		return nil
+	}
+	uplinks.u = nil
+	if u.unified {
+		for _, m := range u.members {
+			unclassify(m.cgroup)
+		}
+	}
+	return restoreQdisc(u.dev)
+}
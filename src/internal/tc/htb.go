@@ -0,0 +1,112 @@
+package tc
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+const (
+	defaultMTU = 1500
+	// ethernetHeader is added to the MTU to get the size of the biggest frame
+	ethernetHeader = 14
+	// burstWindow is how much traffic, in seconds of rate, a class may send at once
+	burstWindow = 0.001
+	// packetBurstWindow is the same as burstWindow for packets per second limits
+	packetBurstWindow = 0.01
+)
+
+// deviceMTU returns the MTU of dev, it is asked to the kernel rather than read from sysfs
+// so it is right for devices of the network namespace the calling thread entered
+func deviceMTU(dev string) int {
+	iface, err := net.InterfaceByName(dev)
+	if err != nil || iface.MTU <= 0 {
+		return defaultMTU
+	}
+	return iface.MTU
+}
+
+// autoBurst returns a burst of burstWindow worth of rate, never smaller than two frames
+// so low rates stay accurate and high rates don't starve between timer ticks
+func autoBurst(rate string, mtu int) string {
+	bps, err := parseRate(rate)
+	if err != nil {
+		return ""
+	}
+	burst := uint64(float64(bps) / 8 * burstWindow)
+	if min := uint64(2 * (mtu + ethernetHeader)); burst < min {
+		burst = min
+	}
+	return fmt.Sprintf("%db", burst)
+}
+
+// autoQuantum returns the bytes a class may dequeue per round, it is kept between one
+// frame and maxQuantum so the kernel never warns about a quantum too big or too small
+func autoQuantum(rate string, mtu int) string {
+	bps, err := parseRate(rate)
+	if err != nil {
+		return ""
+	}
+	quantum := bps / 8 / 10
+	if min := uint64(mtu + ethernetHeader); quantum < min {
+		quantum = min
+	}
+	if quantum > maxQuantum {
+		quantum = maxQuantum
+	}
+	return strconv.FormatUint(quantum, 10)
+}
+
+// htbClassParams returns the parameters appended to an HTB class after rate and ceil
+func htbClassParams(rate, ceil string, tuning docker.Tuning, mtu int) (string, error) {
+	burst, cburst, quantum := tuning.Burst, tuning.Cburst, tuning.Quantum
+	if burst == "" {
+		burst = autoBurst(rate, mtu)
+	}
+	if cburst == "" {
+		cburst = autoBurst(ceil, mtu)
+	}
+	if quantum == "" {
+		quantum = autoQuantum(rate, mtu)
+	} else if q, err := strconv.Atoi(quantum); err != nil || q < mtu+ethernetHeader || q > maxQuantum {
+		return "", fmt.Errorf("invalid quantum %q, must be between %d and %d bytes", quantum, mtu+ethernetHeader, maxQuantum)
+	}
+	if tuning.Overhead != "" {
+		if _, err := strconv.Atoi(tuning.Overhead); err != nil {
+			return "", fmt.Errorf("invalid overhead %q, must be an integer number of bytes", tuning.Overhead)
+		}
+	}
+
+	var params []string
+	for _, p := range []struct{ name, value string }{
+		{"burst", burst},
+		{"cburst", cburst},
+		{"quantum", quantum},
+		{"overhead", tuning.Overhead},
+	} {
+		if p.value != "" {
+			params = append(params, p.name, p.value)
+		}
+	}
+	return strings.Join(params, " "), nil
+}
+
+// packetRatePolicer returns the action enforcing tuning.PacketRate, packets above it are dropped.
+// An empty string is returned when there is no packets per second limit.
+func packetRatePolicer(tuning docker.Tuning) (string, error) {
+	if tuning.PacketRate == "" {
+		return "", nil
+	}
+	pps, err := strconv.ParseUint(strings.TrimSuffix(tuning.PacketRate, "pps"), 10, 64)
+	if err != nil || pps == 0 {
+		return "", fmt.Errorf("invalid packet rate %q, must be a positive number of packets per second", tuning.PacketRate)
+	}
+	burst := uint64(float64(pps) * packetBurstWindow)
+	if burst == 0 {
+		burst = 1
+	}
+	return fmt.Sprintf("action police pkt_rate %d pkt_burst %d conform-exceed drop/pipe", pps, burst), nil
+}
@@ -0,0 +1,96 @@
+package tc
+
+import (
+	"testing"
+
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+func TestAutoBurst(t *testing.T) {
+	tests := []struct {
+		rate string
+		mtu  int
+		want string
+	}{
+		{"1gbit", 1500, "125000b"},
+		{"10mbit", 1500, "3028b"},
+		{"10mbit", 9000, "18028b"},
+		{"100mbps", 1500, "100000b"},
+		{"10%", 1500, ""},
+		{"", 1500, ""},
+	}
+	for _, tt := range tests {
+		if got := autoBurst(tt.rate, tt.mtu); got != tt.want {
+			t.Errorf("autoBurst(%q, %d) = %q, want %q", tt.rate, tt.mtu, got, tt.want)
+		}
+	}
+}
+
+func TestAutoQuantum(t *testing.T) {
+	tests := []struct {
+		rate string
+		mtu  int
+		want string
+	}{
+		{"1mbit", 1500, "12500"},
+		{"10mbit", 1500, "125000"},
+		{"100mbit", 1500, "200000"},
+		{"10kbit", 1500, "1514"},
+		{"10kbit", 9000, "9014"},
+		{"bad", 1500, ""},
+	}
+	for _, tt := range tests {
+		if got := autoQuantum(tt.rate, tt.mtu); got != tt.want {
+			t.Errorf("autoQuantum(%q, %d) = %q, want %q", tt.rate, tt.mtu, got, tt.want)
+		}
+	}
+}
+
+func TestHtbClassParams(t *testing.T) {
+	tests := []struct {
+		rate, ceil string
+		tuning     docker.Tuning
+		want       string
+		ok         bool
+	}{
+		{"10mbit", "1gbit", docker.Tuning{}, "burst 3028b cburst 125000b quantum 125000", true},
+		{"10mbit", "1gbit", docker.Tuning{Burst: "15k", Quantum: "3000", Overhead: "24"}, "burst 15k cburst 125000b quantum 3000 overhead 24", true},
+		{"10mbit", "1gbit", docker.Tuning{Quantum: "1000"}, "", false},
+		{"10mbit", "1gbit", docker.Tuning{Quantum: "300000"}, "", false},
+		{"10mbit", "1gbit", docker.Tuning{Overhead: "lots"}, "", false},
+	}
+	for _, tt := range tests {
+		got, err := htbClassParams(tt.rate, tt.ceil, tt.tuning, 1500)
+		if (err == nil) != tt.ok {
+			t.Errorf("htbClassParams(%q, %q, %+v) error = %v, want ok %t", tt.rate, tt.ceil, tt.tuning, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("htbClassParams(%q, %q, %+v) = %q, want %q", tt.rate, tt.ceil, tt.tuning, got, tt.want)
+		}
+	}
+}
+
+func TestPacketRatePolicer(t *testing.T) {
+	tests := []struct {
+		rate string
+		want string
+		ok   bool
+	}{
+		{"", "", true},
+		{"1000pps", "action police pkt_rate 1000 pkt_burst 10 conform-exceed drop/pipe", true},
+		{"50", "action police pkt_rate 50 pkt_burst 1 conform-exceed drop/pipe", true},
+		{"0pps", "", false},
+		{"fast", "", false},
+	}
+	for _, tt := range tests {
+		got, err := packetRatePolicer(docker.Tuning{PacketRate: tt.rate})
+		if (err == nil) != tt.ok {
+			t.Errorf("packetRatePolicer(%q) error = %v, want ok %t", tt.rate, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("packetRatePolicer(%q) = %q, want %q", tt.rate, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package tc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// kernelVersion returns the major and minor version of the running kernel
+func kernelVersion() (int, int, error) {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseKernelVersion(strings.TrimSpace(string(b)))
+}
+
+func parseKernelVersion(release string) (int, int, error) {
+	fields := strings.SplitN(release, ".", 3)
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("invalid kernel release %q", release)
+	}
+	major, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid kernel release %q", release)
+	}
+	// The minor may be followed by the local version when there is no sublevel, e.g. 5.4-rc1
+	digits := fields[1]
+	if i := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		digits = digits[:i]
+	}
+	minor, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid kernel release %q", release)
+	}
+	return major, minor, nil
+}
+
+// requireKernel fails when the running kernel is older than major.minor, the first
+// version supporting feature. Unknown kernel versions are assumed to support it.
+func requireKernel(feature string, major, minor int) error {
+	kmajor, kminor, err := kernelVersion()
+	if err != nil {
+		return nil
+	}
+	if kmajor < major || (kmajor == major && kminor < minor) {
+		return fmt.Errorf("%s requires kernel %d.%d or newer, running %d.%d", feature, major, minor, kmajor, kminor)
+	}
+	return nil
+}
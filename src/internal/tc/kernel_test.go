@@ -0,0 +1,30 @@
+package tc
+
+import "testing"
+
+func TestParseKernelVersion(t *testing.T) {
+	tests := []struct {
+		release      string
+		major, minor int
+		ok           bool
+	}{
+		{"6.18.44-fc-v139", 6, 18, true},
+		{"4.19.0-25-amd64", 4, 19, true},
+		{"5.15.0", 5, 15, true},
+		{"6.2", 6, 2, true},
+		{"5.4-rc1", 5, 4, true},
+		{"6", 0, 0, false},
+		{"v6.1.0", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		major, minor, err := parseKernelVersion(tt.release)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseKernelVersion(%q) error = %v, want ok %t", tt.release, err, tt.ok)
+			continue
+		}
+		if major != tt.major || minor != tt.minor {
+			t.Errorf("parseKernelVersion(%q) = %d.%d, want %d.%d", tt.release, major, minor, tt.major, tt.minor)
+		}
+	}
+}
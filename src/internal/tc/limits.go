@@ -0,0 +1,68 @@
+package tc
+
+import (
+	"fmt"
+
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+// applyPolicies replaces the label limits of container by the ones currently in force
+func applyPolicies(container *docker.Container) error {
+	if err := applySchedule(container); err != nil {
+		return err
+	}
+	if err := applyCredits(container); err != nil {
+		return err
+	}
+	if err := applyQuota(container); err != nil {
+		return err
+	}
+	return resolveRates(container)
+}
+
+// updateRates computes the limits of a managed container again and changes its classes
+// in place, unlike SetTC its qdiscs, filters and netem are left untouched
+func updateRates(labels docker.Container) error {
+	container := labels
+	if err := applyPolicies(&container); err != nil {
+		return err
+	}
+	if container.Cgroup != "" {
+		if err := updateUplinkRates(&container); err != nil {
+			return err
+		}
+		rememberApplied(container)
+		return nil
+	}
+	err := inNetns(&container, func() error {
+		mtu := deviceMTU(container.Veth)
+		uploadParams, err := htbClassParams(container.UploadRate, container.UploadCeil, container.UploadTuning, mtu)
+		if err != nil {
+			return fmt.Errorf("upload: %v", err)
+		}
+		downloadParams, err := htbClassParams(container.DownloadRate, container.DownloadCeil, container.DownloadTuning, mtu)
+		if err != nil {
+			return fmt.Errorf("download: %v", err)
+		}
+
+		cmd := fmt.Sprintf("/usr/sbin/tc class change dev %s parent 1: classid 1:2 htb rate %s ceil %s prio 2 %s", container.Veth, container.UploadRate, container.UploadCeil, uploadParams)
+		if err := run(cmd); err != nil {
+			return err
+		}
+		if container.Ifb != "" {
+			cmd = fmt.Sprintf("/usr/sbin/tc class change dev %s parent 1: classid 1:1 htb rate %s ceil %s %s", container.Ifb, container.DownloadRate, container.DownloadCeil, downloadParams)
+			return run(cmd)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if container.Pool != "" {
+		if _, _, err := joinPool(&container); err != nil {
+			return err
+		}
+	}
+	rememberApplied(container)
+	return nil
+}
@@ -0,0 +1,287 @@
+package tc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+// getNetemFlags returns the netem parameters of the container labels
+func getNetemFlags(container *docker.Container) (string, error) {
+	delay, variation := container.LatencyDelay, container.LatencyVariation
+	if container.LatencyDistribution != "" {
+		table, err := getDistribution(container.LatencyDistribution)
+		if err != nil {
+			return "", err
+		}
+		// Tables generated from samples default to the measured delay shape
+		if table != nil && delay == "0ms" {
+			delay = fmt.Sprintf("%.3fms", table.Mean)
+		}
+		if table != nil && variation == "" {
+			variation = fmt.Sprintf("%.3fms", table.Stddev)
+		}
+		if delay == "0ms" || variation == "" {
+			return "", fmt.Errorf("latency distribution %s requires latency delay and variation", container.LatencyDistribution)
+		}
+		if strings.HasPrefix(container.LatencyCorrelation, "distribution") {
+			return "", fmt.Errorf("latency distribution and latency correlation %q cannot be used together", container.LatencyCorrelation)
+		}
+	}
+
+	netemFlags := "delay " + delay
+
+	if delay != "0ms" && variation != "" {
+		netemFlags += " " + variation
+		if container.LatencyCorrelation != "" {
+			netemFlags += " " + container.LatencyCorrelation
+		}
+		if container.LatencyDistribution != "" {
+			netemFlags += " distribution " + container.LatencyDistribution
+		}
+	}
+
+	if container.LossModel.Conflict != "" {
+		return "", fmt.Errorf("loss %s and loss %s cannot be used together", container.LossModel.Name, container.LossModel.Conflict)
+	}
+	if container.LossProbability != "" && container.LossModel.Name != "" {
+		return "", fmt.Errorf("loss probability and loss %s cannot be used together", container.LossModel.Name)
+	}
+
+	if container.LossProbability != "" {
+		netemFlags += " loss " + container.LossProbability
+		if container.LossCorrelation != "" {
+			netemFlags += " " + container.LossCorrelation
+		}
+	}
+
+	if container.LossModel.Name != "" {
+		params, err := getLossModelParams(container.LossModel)
+		if err != nil {
+			return "", err
+		}
+		netemFlags += fmt.Sprintf(" loss %s %s", container.LossModel.Name, strings.Join(params, " "))
+	}
+
+	if container.PacketDuplication != "" {
+		netemFlags += " duplicate " + container.PacketDuplication
+	}
+
+	if container.PacketCorruption != "" {
+		netemFlags += " corrupt " + container.PacketCorruption
+	}
+
+	if container.PacketReordering != "" {
+		netemFlags += " reorder " + container.PacketReordering
+	}
+
+	if container.LossECN != "" && container.LossECN != "1" {
+		return "", fmt.Errorf("invalid loss ecn %q, must be 1", container.LossECN)
+	}
+	if container.LossECN == "1" {
+		if container.LossProbability == "" && container.LossModel.Name == "" {
+			return "", fmt.Errorf("loss ecn requires a loss probability or model")
+		}
+		if err := requireKernel("loss ecn", 3, 13); err != nil {
+			return "", err
+		}
+		netemFlags += " ecn"
+	}
+
+	if container.Link.Rate != "" {
+		linkFlags, err := getLinkFlags(container.Link)
+		if err != nil {
+			return "", err
+		}
+		netemFlags += " " + linkFlags
+	}
+
+	if container.Slot != (docker.Slot{}) {
+		slotFlags, err := getSlotFlags(container.Slot)
+		if err != nil {
+			return "", err
+		}
+		netemFlags += " " + slotFlags
+	}
+
+	if container.LossModel.Seed != "" {
+		if seed, err := strconv.ParseUint(container.LossModel.Seed, 10, 64); err != nil || seed == 0 {
+			return "", fmt.Errorf("invalid loss seed %q, must be a positive integer", container.LossModel.Seed)
+		}
+		if err := requireKernel("loss seed", 6, 2); err != nil {
+			return "", err
+		}
+		netemFlags += " seed " + container.LossModel.Seed
+	}
+
+	return netemFlags, nil
+}
+
+// getLossModelParams validates the loss model parameters and returns the ones to pass to netem.
+// Parameters are positional, so one may only be omitted when all the following ones are too.
+func getLossModelParams(model docker.LossModel) ([]string, error) {
+	last := -1
+	for i, p := range model.Params {
+		if p != "" {
+			last = i
+		}
+	}
+	if last < 0 || model.Params[0] == "" {
+		return nil, fmt.Errorf("loss %s requires its first parameter", model.Name)
+	}
+	params := append([]string(nil), model.Params[:last+1]...)
+	for i, p := range params {
+		if p == "" {
+			return nil, fmt.Errorf("loss %s parameter %d is missing but later parameters are set", model.Name, i+1)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSuffix(p, "%"), 64)
+		if err != nil || v < 0 || v > 100 {
+			return nil, fmt.Errorf("invalid loss %s parameter %q, must be a percentage between 0%% and 100%%", model.Name, p)
+		}
+		if !strings.HasSuffix(p, "%") {
+			params[i] = p + "%"
+		}
+	}
+	return params, nil
+}
+
+func getLossModelString(model docker.LossModel) string {
+	if model.Name == "" {
+		return ""
+	}
+	var params []string
+	for i, name := range docker.LossModelParams[model.Name] {
+		if i < len(model.Params) && model.Params[i] != "" {
+			params = append(params, name+"="+model.Params[i])
+		}
+	}
+	return fmt.Sprintf(", loss model: %s %s", model.Name, strings.Join(params, " "))
+}
+
+// getLinkFlags returns the netem rate emulating a link with the given framing
+func getLinkFlags(link docker.Link) (string, error) {
+	if _, err := parseRate(link.Rate); err != nil {
+		return "", fmt.Errorf("link rate: %v", err)
+	}
+	if err := requireKernel("link rate", 3, 3); err != nil {
+		return "", err
+	}
+	// Framing parameters are positional, the ones after the last set are omitted
+	framing := []struct{ name, value string }{
+		{"overhead", link.Overhead},
+		{"cellsize", link.CellSize},
+		{"celloverhead", link.CellOverhead},
+	}
+	last := -1
+	for i, f := range framing {
+		if f.value != "" {
+			last = i
+		}
+	}
+	linkFlags := "rate " + link.Rate
+	if last >= 0 {
+		if err := requireKernel("link framing", 3, 7); err != nil {
+			return "", err
+		}
+	}
+	for _, f := range framing[:last+1] {
+		value := f.value
+		if value == "" {
+			value = "0"
+		}
+		v, err := strconv.Atoi(value)
+		if err != nil || (f.name == "cellsize" && v < 0) {
+			return "", fmt.Errorf("invalid link %s %q", f.name, f.value)
+		}
+		linkFlags += " " + value
+	}
+	return linkFlags, nil
+}
+
+// slotDistributions are the distributions netem accepts for slots
+var slotDistributions = map[string]bool{"uniform": true, "normal": true, "pareto": true, "paretonormal": true}
+
+// getSlotFlags returns the netem slot parameters
+func getSlotFlags(slot docker.Slot) (string, error) {
+	if err := requireKernel("slot", 4, 19); err != nil {
+		return "", err
+	}
+	var slotFlags string
+	if slot.Distribution != "" {
+		if !slotDistributions[slot.Distribution] {
+			return "", fmt.Errorf("invalid slot distribution %q, must be one of uniform, normal, pareto or paretonormal", slot.Distribution)
+		}
+		if slot.Delay == "" || slot.Jitter == "" {
+			return "", fmt.Errorf("slot distribution requires slot delay and jitter")
+		}
+		if slot.Min != "" || slot.Max != "" {
+			return "", fmt.Errorf("slot min and max cannot be used together with slot distribution")
+		}
+		if _, err := parseTime(slot.Delay); err != nil {
+			return "", fmt.Errorf("invalid slot delay %q, must be a time such as 10ms", slot.Delay)
+		}
+		if _, err := parseTime(slot.Jitter); err != nil {
+			return "", fmt.Errorf("invalid slot jitter %q, must be a time such as 10ms", slot.Jitter)
+		}
+		slotFlags = fmt.Sprintf("slot distribution %s %s %s", slot.Distribution, slot.Delay, slot.Jitter)
+	} else {
+		if slot.Min == "" {
+			return "", fmt.Errorf("slot requires slot min or slot distribution")
+		}
+		min, err := parseTime(slot.Min)
+		if err != nil {
+			return "", fmt.Errorf("invalid slot min %q, must be a time such as 10ms", slot.Min)
+		}
+		slotFlags = "slot " + slot.Min
+		if slot.Max != "" {
+			max, err := parseTime(slot.Max)
+			if err != nil {
+				return "", fmt.Errorf("invalid slot max %q, must be a time such as 10ms", slot.Max)
+			}
+			if max < min {
+				return "", fmt.Errorf("slot max %q is lower than slot min %q", slot.Max, slot.Min)
+			}
+			slotFlags += " " + slot.Max
+		}
+	}
+	if slot.Packets != "" {
+		if v, err := strconv.Atoi(slot.Packets); err != nil || v <= 0 {
+			return "", fmt.Errorf("invalid slot packets %q, must be a positive integer", slot.Packets)
+		}
+		slotFlags += " packets " + slot.Packets
+	}
+	if slot.Bytes != "" {
+		// Passed in bytes, tc reads k and m as powers of 1024 and does not know KiB or MiB
+		v, err := parseSize(slot.Bytes)
+		if err != nil || v == 0 {
+			return "", fmt.Errorf("invalid slot bytes %q, must be a positive size such as 64KiB", slot.Bytes)
+		}
+		slotFlags += fmt.Sprintf(" bytes %d", v)
+	}
+	return slotFlags, nil
+}
+
+func getNetemString(c *docker.Container) string {
+	var netemString string
+	for _, p := range []struct{ name, value string }{
+		{"loss ecn", c.LossECN},
+		{"link rate", c.Link.Rate},
+		{"link overhead", c.Link.Overhead},
+		{"link cellsize", c.Link.CellSize},
+		{"link celloverhead", c.Link.CellOverhead},
+		{"slot min", c.Slot.Min},
+		{"slot max", c.Slot.Max},
+		{"slot distribution", c.Slot.Distribution},
+		{"slot delay", c.Slot.Delay},
+		{"slot jitter", c.Slot.Jitter},
+		{"slot packets", c.Slot.Packets},
+		{"slot bytes", c.Slot.Bytes},
+	} {
+		if p.value != "" {
+			netemString += fmt.Sprintf(", %s: %s", p.name, p.value)
+		}
+	}
+	return netemString
+}
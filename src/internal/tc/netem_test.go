@@ -0,0 +1,114 @@
+package tc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+func TestGetLossModelParams(t *testing.T) {
+	tests := []struct {
+		model docker.LossModel
+		want  string
+		ok    bool
+	}{
+		{docker.LossModel{Name: "gemodel", Params: []string{"1%"}}, "1%", true},
+		{docker.LossModel{Name: "gemodel", Params: []string{"1", "10", "", ""}}, "1% 10%", true},
+		{docker.LossModel{Name: "gemodel", Params: []string{"0.5%", "10%", "70%", "0.1%"}}, "0.5% 10% 70% 0.1%", true},
+		{docker.LossModel{Name: "state", Params: []string{"0", "100", "", "", ""}}, "0% 100%", true},
+		{docker.LossModel{Name: "gemodel", Params: []string{"", "10%"}}, "", false},
+		{docker.LossModel{Name: "state", Params: []string{"1%", "", "5%"}}, "", false},
+		{docker.LossModel{Name: "gemodel", Params: []string{"101%"}}, "", false},
+		{docker.LossModel{Name: "gemodel", Params: []string{"-1"}}, "", false},
+		{docker.LossModel{Name: "gemodel", Params: []string{"often"}}, "", false},
+		{docker.LossModel{Name: "gemodel"}, "", false},
+	}
+	for _, tt := range tests {
+		params, err := getLossModelParams(tt.model)
+		if (err == nil) != tt.ok {
+			t.Errorf("getLossModelParams(%v) error = %v, want ok %t", tt.model.Params, err, tt.ok)
+			continue
+		}
+		if got := strings.Join(params, " "); got != tt.want {
+			t.Errorf("getLossModelParams(%v) = %q, want %q", tt.model.Params, got, tt.want)
+		}
+	}
+}
+
+func TestGetLossModelString(t *testing.T) {
+	tests := []struct {
+		model docker.LossModel
+		want  string
+	}{
+		{docker.LossModel{}, ""},
+		{docker.LossModel{Name: "gemodel", Params: []string{"1%", "10%"}}, ", loss model: gemodel p=1% r=10%"},
+		{docker.LossModel{Name: "state", Params: []string{"1%", "", "", "", "2%"}}, ", loss model: state p13=1% p14=2%"},
+	}
+	for _, tt := range tests {
+		if got := getLossModelString(tt.model); got != tt.want {
+			t.Errorf("getLossModelString(%+v) = %q, want %q", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestGetLinkFlags(t *testing.T) {
+	tests := []struct {
+		link docker.Link
+		want string
+		ok   bool
+	}{
+		{docker.Link{Rate: "10mbit"}, "rate 10mbit", true},
+		{docker.Link{Rate: "10mbit", Overhead: "-4"}, "rate 10mbit -4", true},
+		{docker.Link{Rate: "10mbit", CellSize: "53"}, "rate 10mbit 0 53", true},
+		{docker.Link{Rate: "2mbit", Overhead: "10", CellSize: "53", CellOverhead: "5"}, "rate 2mbit 10 53 5", true},
+		{docker.Link{Rate: "10%"}, "", false},
+		{docker.Link{Rate: "10mbit", CellSize: "-1"}, "", false},
+		{docker.Link{Rate: "10mbit", Overhead: "some"}, "", false},
+	}
+	for _, tt := range tests {
+		got, err := getLinkFlags(tt.link)
+		if (err == nil) != tt.ok {
+			t.Errorf("getLinkFlags(%+v) error = %v, want ok %t", tt.link, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("getLinkFlags(%+v) = %q, want %q", tt.link, got, tt.want)
+		}
+	}
+}
+
+func TestGetSlotFlags(t *testing.T) {
+	tests := []struct {
+		slot docker.Slot
+		want string
+		ok   bool
+	}{
+		{docker.Slot{Min: "10ms"}, "slot 10ms", true},
+		{docker.Slot{Min: "800us", Max: "7ms", Packets: "32"}, "slot 800us 7ms packets 32", true},
+		{docker.Slot{Min: "1ms", Bytes: "64KiB"}, "slot 1ms bytes 65536", true},
+		{docker.Slot{Distribution: "pareto", Delay: "10ms", Jitter: "2ms"}, "slot distribution pareto 10ms 2ms", true},
+		{docker.Slot{}, "", false},
+		{docker.Slot{Min: "10"}, "slot 10", true},
+		{docker.Slot{Min: "soon"}, "", false},
+		{docker.Slot{Min: "10ms", Max: "later"}, "", false},
+		{docker.Slot{Min: "10ms", Max: "5ms"}, "", false},
+		{docker.Slot{Distribution: "poisson", Delay: "10ms", Jitter: "2ms"}, "", false},
+		{docker.Slot{Distribution: "normal", Delay: "10ms"}, "", false},
+		{docker.Slot{Distribution: "normal", Delay: "10ms", Jitter: "some"}, "", false},
+		{docker.Slot{Distribution: "normal", Delay: "10ms", Jitter: "2ms", Min: "1ms"}, "", false},
+		{docker.Slot{Min: "10ms", Packets: "0"}, "", false},
+		{docker.Slot{Min: "10ms", Bytes: "0"}, "", false},
+		{docker.Slot{Min: "10ms", Bytes: "lots"}, "", false},
+	}
+	for _, tt := range tests {
+		got, err := getSlotFlags(tt.slot)
+		if (err == nil) != tt.ok {
+			t.Errorf("getSlotFlags(%+v) error = %v, want ok %t", tt.slot, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("getSlotFlags(%+v) = %q, want %q", tt.slot, got, tt.want)
+		}
+	}
+}
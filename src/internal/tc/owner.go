@@ -0,0 +1,335 @@
+package tc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/docker"
+	"github.com/brenozd/tc-docker/pkg/command"
+)
+
+// qdiscFile holds the qdiscs tc-docker installed, in the state directory
+const qdiscFile = "qdiscs.json"
+
+// tc-docker only installs root qdiscs with handle 1: and ingress qdiscs, always ffff:, and records
+// each of them by device and interface index so they are known as its own after a restart.
+// Any other qdisc found on a device it didn't create, unless it is the default one of the device
+// with handle 0:, belongs to someone else and is only replaced when the foreignQdiscs policy of
+// the config is force.
+type ownedQdisc struct {
+	Index  int    `json:"index"`
+	Kind   string `json:"kind"`
+	Handle string `json:"handle"`
+	// Previous is the kind and handle of the qdisc it replaced, so restoreQdisc can put it back
+	Previous string `json:"previous,omitempty"`
+}
+
+// owned holds the recorded qdiscs keyed by network namespace, device and parent, see qdiscKey.
+// adopt is set when no qdiscs were recorded yet, e.g. on the first start after upgrading from a
+// release without the state file, until AdoptQdiscs runs.
+var owned = struct {
+	sync.Mutex
+	m     map[string]ownedQdisc
+	adopt bool
+}{m: make(map[string]ownedQdisc)}
+
+// ForeignQdiscError is returned when shaping would replace a qdisc tc-docker didn't create
+type ForeignQdiscError struct {
+	Dev    string
+	Parent string
+	Qdisc  string
+}
+
+func (e *ForeignQdiscError) Error() string {
+	return fmt.Sprintf("%s qdisc of %s is %s, not created by tc-docker, set foreignQdiscs to force in config to replace it", e.Parent, e.Dev, e.Qdisc)
+}
+
+// qdiscKey identifies a qdisc of a device, devices inside a container network namespace are
+// keyed by the namespace path too since their names are only unique there
+func qdiscKey(netns, dev, parent string) string {
+	return netns + "/" + dev + "/" + parent
+}
+
+// currentQdisc returns the kind and handle of the root or ingress qdisc of dev, empty when there is none
+func currentQdisc(dev, parent string) (string, string, error) {
+	cmd := fmt.Sprintf("/usr/sbin/tc qdisc show dev %s %s", dev, parent)
+	out, err := command.CombinedOutput(cmd)
+	if err != nil {
+		return "", "", fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// qdisc <kind> <handle> root|parent ...
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "qdisc" {
+			return fields[1], fields[2], nil
+		}
+	}
+	return "", "", nil
+}
+
+// claimQdisc checks that the root or ingress qdisc of dev may be replaced and returns the kind
+// and handle of the qdisc tc-docker first replaced on it, empty when there was none
+func claimQdisc(netns, dev, parent string) (string, error) {
+	kind, handle, err := currentQdisc(dev, parent)
+	if err != nil {
+		return "", err
+	}
+	if kind == "" {
+		return "", nil
+	}
+	current := kind + " " + handle
+	if handle == "0:" {
+		return current, nil
+	}
+	owned.Lock()
+	q, ok := owned.m[qdiscKey(netns, dev, parent)]
+	owned.Unlock()
+	if ok && q.Kind == kind && q.Handle == handle && q.Index == deviceIndex(dev) {
+		return q.Previous, nil
+	}
+	foreign := &ForeignQdiscError{Dev: dev, Parent: parent, Qdisc: current}
+	if global.Conf.ForeignQdiscs == global.ForeignQdiscsForce {
+		glog.Warnf("Replacing foreign qdisc, %s qdisc of %s is %s", parent, dev, foreign.Qdisc)
+		return current, nil
+	}
+	return "", foreign
+}
+
+// replaceQdisc installs qdisc, its kind and parameters, with the given handle as the root or ingress
+// qdisc of dev in place of the current one unless it is foreign, and records it as tc-docker's own
+func replaceQdisc(netns, dev, parent, handle, qdisc string) error {
+	previous, err := claimQdisc(netns, dev, parent)
+	if err != nil {
+		return err
+	}
+	return install(netns, dev, parent, handle, qdisc, previous)
+}
+
+// installQdisc is replaceQdisc for devices tc-docker created, e.g. ifbs, whose qdiscs are all its own
+func installQdisc(netns, dev, parent, handle, qdisc string) error {
+	return install(netns, dev, parent, handle, qdisc, "")
+}
+
+func install(netns, dev, parent, handle, qdisc, previous string) error {
+	if err := runIgnoreNotFound(fmt.Sprintf("/usr/sbin/tc qdisc del dev %s %s", dev, parent)); err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("/usr/sbin/tc qdisc add dev %s %s", dev, parent)
+	kind := parent
+	if parent == "root" {
+		cmd += fmt.Sprintf(" handle %s %s", handle, qdisc)
+		kind = strings.Fields(qdisc)[0]
+	}
+	if err := run(cmd); err != nil {
+		return err
+	}
+	owned.Lock()
+	owned.m[qdiscKey(netns, dev, parent)] = ownedQdisc{Index: deviceIndex(dev), Kind: kind, Handle: handle, Previous: previous}
+	owned.Unlock()
+	return saveQdiscs()
+}
+
+// restoreQdisc deletes the root qdisc tc-docker installed on a host device and puts back the one it replaced.
+// The default qdisc of the device, handle 0:, comes back on its own, any other is added again with its
+// default parameters.
+func restoreQdisc(dev string) error {
+	key := qdiscKey("", dev, "root")
+	owned.Lock()
+	q, ok := owned.m[key]
+	delete(owned.m, key)
+	owned.Unlock()
+	if err := saveQdiscs(); err != nil {
+		glog.Errorf("Saving owned qdiscs failed, error: %v", err)
+	}
+	if !ok {
+		return nil
+	}
+	if err := runIgnoreNotFound(fmt.Sprintf("/usr/sbin/tc qdisc del dev %s root", dev)); err != nil {
+		return err
+	}
+	previous := strings.Fields(q.Previous)
+	if len(previous) != 2 || previous[1] == "0:" {
+		return nil
+	}
+	glog.Warnf("Restoring root qdisc of %s, %s, with its default parameters", dev, q.Previous)
+	return run(fmt.Sprintf("/usr/sbin/tc qdisc add dev %s root handle %s %s", dev, previous[1], previous[0]))
+}
+
+// deviceIndex returns the interface index of dev in the network namespace of the calling thread, 0 when it is gone
+func deviceIndex(dev string) int {
+	iface, err := net.InterfaceByName(dev)
+	if err != nil {
+		return 0
+	}
+	return iface.Index
+}
+
+// Present tells whether the veth of a container still exists, inside its network namespace when it is shaped there
+func Present(container docker.Container) bool {
+	err := inNetns(&container, func() error {
+		_, err := net.InterfaceByName(container.Veth)
+		return err
+	})
+	return err == nil
+}
+
+// Intact tells whether the qdiscs recorded for the devices of a container, its veth and ifb,
+// are still in place, they are lost when a device is recreated or a qdisc deleted
+func Intact(container docker.Container) bool {
+	intact := true
+	err := inNetns(&container, func() error {
+		for _, dev := range []string{container.Veth, container.Ifb} {
+			for _, parent := range []string{"root", "ingress"} {
+				owned.Lock()
+				q, ok := owned.m[qdiscKey(container.Netns, dev, parent)]
+				owned.Unlock()
+				if !ok {
+					continue
+				}
+				kind, handle, err := currentQdisc(dev, parent)
+				if err != nil || kind != q.Kind || handle != q.Handle || deviceIndex(dev) != q.Index {
+					intact = false
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	return err == nil && intact
+}
+
+// AdoptQdiscs records as tc-docker's own the qdiscs of the veths of the containers found on startup
+// when no qdiscs were recorded yet, as the qdiscs of a release which didn't record them. Only veths
+// carrying the whole tree of SetTC are adopted, the htb 1: root with class 1:2 and netem 10: below
+// it and the ingress redirected by mirred. Adoption ends with the first call.
+func AdoptQdiscs(containers []*docker.Container) {
+	owned.Lock()
+	adopt := owned.adopt
+	owned.adopt = false
+	owned.Unlock()
+	if !adopt {
+		return
+	}
+	adopted := 0
+	for _, container := range containers {
+		if container.Cgroup != "" {
+			continue
+		}
+		shaped, index := false, 0
+		err := inNetns(container, func() error {
+			shaped, index = shapedTree(container.Veth), deviceIndex(container.Veth)
+			return nil
+		})
+		if err != nil || !shaped {
+			continue
+		}
+		owned.Lock()
+		owned.m[qdiscKey(container.Netns, container.Veth, "root")] = ownedQdisc{Index: index, Kind: "htb", Handle: "1:"}
+		owned.m[qdiscKey(container.Netns, container.Veth, "ingress")] = ownedQdisc{Index: index, Kind: "ingress", Handle: "ffff:"}
+		owned.Unlock()
+		glog.Infof("Adopting qdiscs installed before qdiscs were recorded, container: %s, veth: %s", container.Name, container.Veth)
+		adopted++
+	}
+	if adopted > 0 {
+		if err := saveQdiscs(); err != nil {
+			glog.Errorf("Saving owned qdiscs failed, error: %v", err)
+		}
+	}
+}
+
+// shapedTree tells whether dev carries the tree SetTC builds on a veth
+func shapedTree(dev string) bool {
+	qdiscs, err := command.CombinedOutput(fmt.Sprintf("/usr/sbin/tc qdisc show dev %s", dev))
+	if err != nil {
+		return false
+	}
+	classes, err := command.CombinedOutput(fmt.Sprintf("/usr/sbin/tc class show dev %s classid 1:2", dev))
+	if err != nil {
+		return false
+	}
+	filters, err := command.CombinedOutput(fmt.Sprintf("/usr/sbin/tc filter show dev %s ingress", dev))
+	if err != nil {
+		return false
+	}
+	return hasQdisc(qdiscs, "htb", "1:", "root") && hasQdisc(qdiscs, "netem", "10:", "1:2") &&
+		hasQdisc(qdiscs, "ingress", "ffff:", "ffff:fff1") && strings.Contains(string(classes), "class htb 1:2 ") &&
+		strings.Contains(string(filters), "mirred")
+}
+
+// hasQdisc tells whether the output of tc qdisc show lists a qdisc of kind with handle below parent, root for the root qdisc
+func hasQdisc(out []byte, kind, handle, parent string) bool {
+	for _, line := range strings.Split(string(out), "\n") {
+		// qdisc <kind> <handle> root|parent <parent> ...
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "qdisc" || fields[1] != kind || fields[2] != handle {
+			continue
+		}
+		if fields[3] == "root" && parent == "root" || len(fields) >= 5 && fields[3] == "parent" && fields[4] == parent {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetQdiscs drops the records of the devices of a released container
+func forgetQdiscs(container docker.Container) {
+	owned.Lock()
+	for _, dev := range []string{container.Veth, container.Ifb} {
+		for _, parent := range []string{"root", "ingress"} {
+			delete(owned.m, qdiscKey(container.Netns, dev, parent))
+		}
+	}
+	owned.Unlock()
+	if err := saveQdiscs(); err != nil {
+		glog.Errorf("Saving owned qdiscs failed, error: %v", err)
+	}
+}
+
+// LoadQdiscs reads the qdiscs tc-docker installed before a restart from the state directory. Without
+// the file the trees of the containers found on startup are adopted, see AdoptQdiscs.
+func LoadQdiscs() error {
+	path := filepath.Join(global.Conf.StateDir, qdiscFile)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		owned.Lock()
+		owned.adopt = true
+		owned.Unlock()
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read owned qdiscs %s, error: %v", path, err)
+	}
+	owned.Lock()
+	defer owned.Unlock()
+	if err := json.Unmarshal(b, &owned.m); err != nil {
+		return fmt.Errorf("failed to parse owned qdiscs %s, error: %v", path, err)
+	}
+	return nil
+}
+
+// saveQdiscs writes the owned qdiscs to the state directory, owned stays locked meanwhile
+// so concurrent saves don't share the temporary file
+func saveQdiscs() error {
+	owned.Lock()
+	defer owned.Unlock()
+	b, err := json.Marshal(owned.m)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(global.Conf.StateDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(global.Conf.StateDir, qdiscFile)
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,295 @@
+package tc
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+const (
+	// Partitions use filter preferences starting here, lower than the matchall
+	// filters of SetTC so drops happen before any classification or redirection
+	firstPartitionPref = 10
+
+	PartitionBoth    = "both"
+	PartitionEgress  = "egress"
+	PartitionIngress = "ingress"
+
+	PartitionSourceLabel = "label"
+	PartitionSourceAPI   = "api"
+)
+
+// Partition cuts the traffic between a container and a peer, a CIDR, an IP or another container.
+// With egress the container cannot send to the peer, with ingress it cannot receive from it.
+type Partition struct {
+	Container string `json:"container"`
+	Peer      string `json:"peer"`
+	Direction string `json:"direction"`
+	Source    string `json:"source"`
+	pref      int
+}
+
+// ResolvePeer returns the IPs of the named container, it is set by the daemon
+var ResolvePeer func(name string) ([]string, error)
+
+// partitions are keyed by container name so they survive container restarts
+var partitions = struct {
+	sync.Mutex
+	m map[string][]*Partition
+}{m: make(map[string][]*Partition)}
+
+// AddPartition cuts the container from the peer on every veth of the container
+func AddPartition(p Partition) error {
+	if p.Direction == "" {
+		p.Direction = PartitionBoth
+	}
+	if p.Direction != PartitionBoth && p.Direction != PartitionEgress && p.Direction != PartitionIngress {
+		return fmt.Errorf("invalid partition direction %q, must be one of both, egress or ingress", p.Direction)
+	}
+	p.Source = PartitionSourceAPI
+	if sharesHostNetwork(p.Container) {
+		return fmt.Errorf("container %s shares the host network, partitions are not supported", p.Container)
+	}
+	veths := managedVeths(p.Container)
+	if len(veths) == 0 {
+		return fmt.Errorf("container %s is not shaped by tc-docker", p.Container)
+	}
+	peerCIDRs, err := resolvePartitionPeer(p.Peer)
+	if err != nil {
+		return err
+	}
+
+	partitions.Lock()
+	defer partitions.Unlock()
+	for _, existing := range partitions.m[p.Container] {
+		if existing.Peer == p.Peer {
+			return fmt.Errorf("container %s is already partitioned from %s", p.Container, p.Peer)
+		}
+	}
+	p.pref = allocPartitionPref(partitions.m[p.Container])
+	for i := range veths {
+		if err := installPartition(&p, &veths[i], peerCIDRs); err != nil {
+			return err
+		}
+	}
+	partitions.m[p.Container] = append(partitions.m[p.Container], &p)
+	glog.Infof("Partition added, container: %s, peer: %s, direction: %s", p.Container, p.Peer, p.Direction)
+	return nil
+}
+
+// HealPartition removes the partition between the container and the peer, or every
+// partition of the container when peer is empty. Shaping classes are left untouched.
+func HealPartition(container, peer string) error {
+	partitions.Lock()
+	defer partitions.Unlock()
+	var kept []*Partition
+	healed := 0
+	for _, p := range partitions.m[container] {
+		if peer != "" && p.Peer != peer {
+			kept = append(kept, p)
+			continue
+		}
+		veths := managedVeths(container)
+		for i := range veths {
+			if err := uninstallPartition(p, &veths[i]); err != nil {
+				return err
+			}
+		}
+		healed++
+		glog.Infof("Partition healed, container: %s, peer: %s", container, p.Peer)
+	}
+	if healed == 0 {
+		return fmt.Errorf("container %s has no partition to heal", container)
+	}
+	partitions.m[container] = kept
+	return nil
+}
+
+// ListPartitions returns every partition sorted by container and peer
+func ListPartitions() []Partition {
+	partitions.Lock()
+	defer partitions.Unlock()
+	var list []Partition
+	for _, ps := range partitions.m {
+		for _, p := range ps {
+			list = append(list, *p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Container != list[j].Container {
+			return list[i].Container < list[j].Container
+		}
+		return list[i].Peer < list[j].Peer
+	})
+	return list
+}
+
+// applyPartitions syncs the partitions declared in the container labels and installs
+// every partition of the container on container.Veth. Partitions whose peer is the
+// container are installed again on their owners since the peer IPs may have changed.
+func applyPartitions(container *docker.Container) error {
+	partitions.Lock()
+	defer partitions.Unlock()
+
+	if err := syncLabelPartitions(container); err != nil {
+		return err
+	}
+	for _, p := range partitions.m[container.Name] {
+		peerCIDRs, err := resolvePartitionPeer(p.Peer)
+		if err != nil {
+			return err
+		}
+		if err := installPartition(p, container, peerCIDRs); err != nil {
+			return err
+		}
+	}
+
+	for owner, ps := range partitions.m {
+		for _, p := range ps {
+			if p.Peer != container.Name {
+				continue
+			}
+			peerCIDRs, err := resolvePartitionPeer(p.Peer)
+			if err != nil {
+				return err
+			}
+			veths := managedVeths(owner)
+			for i := range veths {
+				if err := uninstallPartition(p, &veths[i]); err != nil {
+					return err
+				}
+				if err := installPartition(p, &veths[i], peerCIDRs); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// syncLabelPartitions replaces the label partitions of the container by the ones in its labels.
+// Must be called with partitions locked.
+func syncLabelPartitions(container *docker.Container) error {
+	direction := container.PartitionDirection
+	if direction == "" {
+		direction = PartitionBoth
+	}
+	if direction != PartitionBoth && direction != PartitionEgress && direction != PartitionIngress {
+		return fmt.Errorf("invalid partition direction %q, must be one of both, egress or ingress", direction)
+	}
+	peers := make(map[string]bool)
+	for _, peer := range strings.Split(container.Partition, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers[peer] = true
+		}
+	}
+
+	var kept []*Partition
+	for _, p := range partitions.m[container.Name] {
+		if p.Source == PartitionSourceLabel && !peers[p.Peer] {
+			continue
+		}
+		if p.Source == PartitionSourceLabel {
+			p.Direction = direction
+		}
+		delete(peers, p.Peer)
+		kept = append(kept, p)
+	}
+	for peer := range peers {
+		kept = append(kept, &Partition{
+			Container: container.Name,
+			Peer:      peer,
+			Direction: direction,
+			Source:    PartitionSourceLabel,
+			pref:      allocPartitionPref(kept),
+		})
+	}
+	partitions.m[container.Name] = kept
+	return nil
+}
+
+// allocPartitionPref returns the lowest filter preference none of the partitions of a container holds
+func allocPartitionPref(existing []*Partition) int {
+	used := make(map[int]bool)
+	for _, p := range existing {
+		used[p.pref] = true
+	}
+	return lowestUnused(firstPartitionPref, used)
+}
+
+// resolvePartitionPeer returns the IPv4 CIDRs of a CIDR, an IP or a container name
+func resolvePartitionPeer(peer string) ([]string, error) {
+	if _, cidr, err := net.ParseCIDR(peer); err == nil {
+		if cidr.IP.To4() == nil {
+			return nil, fmt.Errorf("partition peer %s: only IPv4 is supported", peer)
+		}
+		return []string{cidr.String()}, nil
+	}
+	if ip := net.ParseIP(peer); ip != nil {
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("partition peer %s: only IPv4 is supported", peer)
+		}
+		return []string{ip.String() + "/32"}, nil
+	}
+	if ResolvePeer == nil {
+		return nil, fmt.Errorf("cannot resolve partition peer %s", peer)
+	}
+	ips, err := ResolvePeer(peer)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve partition peer %s: %v", peer, err)
+	}
+	var cidrs []string
+	for _, ip := range ips {
+		cidrs = append(cidrs, ip+"/32")
+	}
+	return cidrs, nil
+}
+
+// installPartition adds drop filters for the peer CIDRs. Traffic sent by the container
+// is seen on the veth ingress qdisc, traffic sent to it on the veth root HTB. Inside the
+// network namespace of the container it is the other way around.
+func installPartition(p *Partition, container *docker.Container, peerCIDRs []string) error {
+	sent, received := partitionParents(container)
+	return inNetns(container, func() error {
+		for _, cidr := range peerCIDRs {
+			if p.Direction == PartitionBoth || p.Direction == PartitionEgress {
+				cmd := fmt.Sprintf("/usr/sbin/tc filter add dev %s parent %s protocol ip pref %d u32 match ip dst %s action drop", container.Veth, sent, p.pref, cidr)
+				if err := run(cmd); err != nil {
+					return err
+				}
+			}
+			if p.Direction == PartitionBoth || p.Direction == PartitionIngress {
+				cmd := fmt.Sprintf("/usr/sbin/tc filter add dev %s parent %s protocol ip pref %d u32 match ip src %s action drop", container.Veth, received, p.pref, cidr)
+				if err := run(cmd); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func uninstallPartition(p *Partition, container *docker.Container) error {
+	return inNetns(container, func() error {
+		// One-way partitions only have filters on one of the parents
+		for _, parent := range []string{"ffff:", "1:"} {
+			if err := deleteFilter(container.Veth, parent, p.pref); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// partitionParents returns the qdiscs seeing the traffic sent and received by the container
+func partitionParents(container *docker.Container) (string, string) {
+	if container.Netns != "" {
+		return "1:", "ffff:"
+	}
+	return "ffff:", "1:"
+}
@@ -0,0 +1,235 @@
+package tc
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+// A pool shares one upload and one download budget between all of its members.
+// Each direction is shaped on a host-level ifb holding an HTB tree where class 1:1
+// carries the pool limits and every member gets a child class borrowing from it.
+// Member traffic is tagged with its class through skbedit priority and redirected
+// to the pool ifb before reaching the member's own classes.
+type pool struct {
+	name    string
+	limits  global.Pool
+	upIfb   string
+	downIfb string
+	members map[string]*poolMember
+}
+
+type poolMember struct {
+	id           string
+	veth         string
+	minor        int
+	uploadRate   string
+	uploadCeil   string
+	downloadRate string
+	downloadCeil string
+}
+
+// firstPoolMinor is the class minor of the first member on the pool ifbs
+const firstPoolMinor = 0x10
+
+var pools = struct {
+	sync.Mutex
+	m map[string]*pool
+}{m: make(map[string]*pool)}
+
+// hashedIfbName derives a stable, at most 15 characters long, ifb name from a pool or device name
+func hashedIfbName(name, suffix string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("tcp%08x%s", h.Sum32(), suffix)
+}
+
+func memberKey(id, veth string) string {
+	return id + "/" + veth
+}
+
+// joinPool adds the container to its pool, creating the pool ifbs on first use,
+// and returns the member holding the class it was assigned to
+func joinPool(container *docker.Container) (*pool, *poolMember, error) {
+	pools.Lock()
+	defer pools.Unlock()
+
+	p, err := getPool(container.Pool)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := memberKey(container.ID, container.Veth)
+	m, exists := p.members[key]
+	if !exists {
+		m = &poolMember{id: container.ID, veth: container.Veth, minor: p.freeMinor()}
+	}
+	m.uploadRate, m.uploadCeil = container.UploadRate, container.UploadCeil
+	m.downloadRate, m.downloadCeil = container.DownloadRate, container.DownloadCeil
+	p.members[key] = m
+
+	for _, ifb := range []string{p.upIfb, p.downIfb} {
+		verb := "add"
+		if exists {
+			verb = "change"
+		}
+		cmd := fmt.Sprintf("/usr/sbin/tc class %s dev %s parent 1:1 classid 1:%x htb rate 1bit", verb, ifb, m.minor)
+		if err := run(cmd); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := p.rebalance(); err != nil {
+		return nil, nil, err
+	}
+	glog.Debugf("joinPool, pool: %s, container: %s, veth: %s, class: 1:%x", p.name, container.Name, container.Veth, m.minor)
+	return p, m, nil
+}
+
+// LeavePool removes every class the container owns in its pool and shares
+// the freed bandwidth among the remaining members
+func LeavePool(id string) error {
+	pools.Lock()
+	defer pools.Unlock()
+
+	for _, p := range pools.m {
+		removed := false
+		for key, m := range p.members {
+			if m.id != id {
+				continue
+			}
+			for _, ifb := range []string{p.upIfb, p.downIfb} {
+				cmd := fmt.Sprintf("/usr/sbin/tc class del dev %s classid 1:%x", ifb, m.minor)
+				if err := run(cmd); err != nil {
+					glog.Errorf("LeavePool, pool: %s, error: %v", p.name, err)
+				}
+			}
+			delete(p.members, key)
+			removed = true
+		}
+		if removed {
+			glog.Debugf("LeavePool, pool: %s, container: %s, remaining members: %d", p.name, id, len(p.members))
+			if err := p.rebalance(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// poolDownloadClass returns the pool ifb and the class minor carrying the download traffic of a member
+func poolDownloadClass(id, veth string) (string, int, bool) {
+	pools.Lock()
+	defer pools.Unlock()
+	for _, p := range pools.m {
+		if m, ok := p.members[memberKey(id, veth)]; ok {
+			return p.downIfb, m.minor, true
+		}
+	}
+	return "", 0, false
+}
+
+// getPool returns the named pool, setting up its ifbs the first time it is used.
+// Must be called with pools locked.
+func getPool(name string) (*pool, error) {
+	if p, ok := pools.m[name]; ok {
+		return p, nil
+	}
+	if _, ok := global.Conf.Pools[name]; !ok {
+		return nil, fmt.Errorf("pool %s is not defined in config", name)
+	}
+	p := &pool{
+		name:    name,
+		limits:  resolvePool(name),
+		upIfb:   hashedIfbName(name, "u"),
+		downIfb: hashedIfbName(name, "d"),
+		members: make(map[string]*poolMember),
+	}
+	for _, ifb := range []string{p.upIfb, p.downIfb} {
+		if err := run(fmt.Sprintf("/usr/sbin/ip link show dev %s", ifb)); err != nil {
+			if err := run(fmt.Sprintf("/usr/sbin/ip link add name %s type ifb", ifb)); err != nil {
+				return nil, err
+			}
+		}
+		if err := run(fmt.Sprintf("/usr/sbin/ip link set dev %s up", ifb)); err != nil {
+			return nil, err
+		}
+		// Unclassified traffic should never show up here, but if it does it must not escape the pool limits
+		if err := installQdisc("", ifb, "root", "1:", "htb default 1"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.applyLimits("add"); err != nil {
+		return nil, err
+	}
+	pools.m[name] = p
+	glog.Infof("Pool %s ready, upload ifb: %s, download ifb: %s", name, p.upIfb, p.downIfb)
+	return p, nil
+}
+
+// freeMinor returns the lowest class minor no member holds, must be called with pools locked
+func (p *pool) freeMinor() int {
+	used := make(map[int]bool)
+	for _, m := range p.members {
+		used[m.minor] = true
+	}
+	return lowestUnused(firstPoolMinor, used)
+}
+
+// applyLimits sets the pool rate and ceil on the class 1:1 of both pool ifbs, verb is either add or change.
+// Must be called with pools locked or on a copy of the pool.
+func (p *pool) applyLimits(verb string) error {
+	for _, d := range []struct {
+		dev   string
+		limit global.Limit
+	}{{p.upIfb, p.limits.Upload}, {p.downIfb, p.limits.Download}} {
+		cmd := fmt.Sprintf("/usr/sbin/tc class %s dev %s parent 1: classid 1:1 htb rate %s ceil %s", verb, d.dev, d.limit.Rate, d.limit.Ceil)
+		if err := run(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebalance splits the pool rate equally among members, every member may borrow
+// up to the pool ceil unless its own labels set a lower limit.
+// Must be called with pools locked.
+func (p *pool) rebalance() error {
+	if len(p.members) == 0 {
+		return nil
+	}
+	for _, d := range []struct {
+		dev   string
+		limit global.Limit
+		rate  func(*poolMember) (string, string)
+	}{
+		{p.upIfb, p.limits.Upload, func(m *poolMember) (string, string) { return m.uploadRate, m.uploadCeil }},
+		{p.downIfb, p.limits.Download, func(m *poolMember) (string, string) { return m.downloadRate, m.downloadCeil }},
+	} {
+		share := d.limit.Rate
+		if total, err := parseRate(d.limit.Rate); err == nil {
+			share = formatRate(total / uint64(len(p.members)))
+		}
+		for _, m := range p.members {
+			memberRate, memberCeil := d.rate(m)
+			ceil := minRate(d.limit.Ceil, memberCeil)
+			rate := minRate(share, memberRate, ceil)
+			cmd := fmt.Sprintf("/usr/sbin/tc class change dev %s parent 1:1 classid 1:%x htb rate %s ceil %s", d.dev, m.minor, rate, ceil)
+			if quantum := autoQuantum(rate, defaultMTU); quantum != "" {
+				cmd += " quantum " + quantum
+			}
+			if err := run(cmd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// poolRedirect returns the actions that tag traffic with the member class and send it to the pool ifb
+func poolRedirect(m *poolMember, ifb string) string {
+	return fmt.Sprintf("action skbedit priority 1:%x pipe action mirred egress redirect dev %s", m.minor, ifb)
+}
@@ -0,0 +1,339 @@
+package tc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/docker"
+	"github.com/brenozd/tc-docker/internal/metrics"
+)
+
+// quotaFile is where usage is saved, in global.Conf.StateDir
+const quotaFile = "quotas.json"
+
+// quotaUsage is the traffic of a container since the start of its current quota window.
+// It is keyed by container name so it survives container and daemon restarts.
+type quotaUsage struct {
+	Window   string    `json:"window"`
+	Start    time.Time `json:"start"`
+	Upload   uint64    `json:"upload"`
+	Download uint64    `json:"download"`
+}
+
+// quotaLimits is a parsed docker.Quota, a zero quota means the direction is not capped
+type quotaLimits struct {
+	upload          uint64
+	download        uint64
+	window          string
+	uploadPenalty   string
+	downloadPenalty string
+}
+
+var quotas = struct {
+	sync.Mutex
+	usage map[string]*quotaUsage
+	// throttled holds the directions limited to their penalty on each managed veth
+	throttled map[string][2]bool
+	dirty     bool
+}{usage: make(map[string]*quotaUsage), throttled: make(map[string][2]bool)}
+
+func parseQuota(q docker.Quota) (quotaLimits, error) {
+	limits := quotaLimits{window: q.Window, uploadPenalty: q.UploadPenalty, downloadPenalty: q.DownloadPenalty}
+	if limits.window == "" {
+		limits.window = "day"
+	}
+	if _, err := quotaWindowStart(limits.window, time.Now()); err != nil {
+		return limits, err
+	}
+	var err error
+	if q.Upload != "" {
+		if limits.upload, err = parseSize(q.Upload); err != nil || limits.upload == 0 {
+			return limits, fmt.Errorf("invalid upload quota %q", q.Upload)
+		}
+		if q.UploadPenalty == "" {
+			return limits, fmt.Errorf("upload quota requires an upload penalty rate")
+		}
+	}
+	if q.Download != "" {
+		if limits.download, err = parseSize(q.Download); err != nil || limits.download == 0 {
+			return limits, fmt.Errorf("invalid download quota %q", q.Download)
+		}
+		if q.DownloadPenalty == "" {
+			return limits, fmt.Errorf("download quota requires a download penalty rate")
+		}
+	}
+	return limits, nil
+}
+
+// quotaWindowStart returns the start of the window holding now. Windows are either calendar
+// aligned, day, week (starting on monday) or month, or a duration such as 12h.
+func quotaWindowStart(window string, now time.Time) (time.Time, error) {
+	y, m, d := now.Date()
+	switch window {
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, now.Location()), nil
+	case "week":
+		return time.Date(y, m, d-(int(now.Weekday())+6)%7, 0, 0, 0, 0, now.Location()), nil
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, now.Location()), nil
+	}
+	duration, err := time.ParseDuration(window)
+	if err != nil || duration <= 0 {
+		return time.Time{}, fmt.Errorf("invalid quota window %q, must be day, week, month or a duration", window)
+	}
+	return now.Truncate(duration), nil
+}
+
+// getUsage returns the usage of the named container, starting a new one when its window is over.
+// Must be called with quotas locked.
+func getUsage(name, window string, now time.Time) *quotaUsage {
+	start, _ := quotaWindowStart(window, now)
+	u, ok := quotas.usage[name]
+	if !ok || u.Window != window || !u.Start.Equal(start) {
+		if ok && u.Start.Before(start) {
+			glog.Infof("Quota window reset, container: %s, upload: %d bytes, download: %d bytes", name, u.Upload, u.Download)
+		}
+		u = &quotaUsage{Window: window, Start: start}
+		quotas.usage[name] = u
+		quotas.dirty = true
+	}
+	return u
+}
+
+// throttledDirections tells which directions of the container have used up their quota
+func throttledDirections(name string, limits quotaLimits) [2]bool {
+	quotas.Lock()
+	defer quotas.Unlock()
+	u := getUsage(name, limits.window, time.Now())
+	return [2]bool{
+		limits.upload > 0 && u.Upload >= limits.upload,
+		limits.download > 0 && u.Download >= limits.download,
+	}
+}
+
+// applyQuota limits the directions whose quota is used up to their penalty rate
+// and records it so the watcher only acts when the throttling changes
+func applyQuota(container *docker.Container) error {
+	if container.Quota == (docker.Quota{}) {
+		return nil
+	}
+	limits, err := parseQuota(container.Quota)
+	if err != nil {
+		return err
+	}
+	throttled := throttledDirections(container.Name, limits)
+	quotas.Lock()
+	quotas.throttled[memberKey(container.ID, container.Veth)] = throttled
+	quotas.Unlock()
+	if throttled[0] {
+		overrideLimit(&container.UploadRate, &container.UploadCeil, global.Limit{Rate: limits.uploadPenalty})
+	}
+	if throttled[1] {
+		overrideLimit(&container.DownloadRate, &container.DownloadCeil, global.Limit{Rate: limits.downloadPenalty})
+	}
+	return nil
+}
+
+// account adds the traffic of the container classes since the last call to its usage
+func account(container *docker.Container, limits quotaLimits) error {
+	delta, err := trafficDelta("quota", container)
+	if err != nil {
+		return err
+	}
+	quotas.Lock()
+	defer quotas.Unlock()
+	if delta[0] > 0 || delta[1] > 0 {
+		u := getUsage(container.Name, limits.window, time.Now())
+		u.Upload += delta[0]
+		u.Download += delta[1]
+		quotas.dirty = true
+	}
+	return nil
+}
+
+// LoadQuotas reads the quota usage saved by a previous run
+func LoadQuotas() error {
+	path := filepath.Join(global.Conf.StateDir, quotaFile)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read quota usage %s, error: %v", path, err)
+	}
+	quotas.Lock()
+	defer quotas.Unlock()
+	if err := json.Unmarshal(b, &quotas.usage); err != nil {
+		return fmt.Errorf("failed to parse quota usage %s, error: %v", path, err)
+	}
+	return nil
+}
+
+// saveQuotas writes the quota usage to the state directory when it changed
+func saveQuotas() error {
+	quotas.Lock()
+	if !quotas.dirty {
+		quotas.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(quotas.usage)
+	quotas.dirty = false
+	quotas.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(global.Conf.StateDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(global.Conf.StateDir, quotaFile)
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// SaveQuotas writes the quota usage now, before the daemon hands over to another instance
+func SaveQuotas() error {
+	return saveQuotas()
+}
+
+// forgetQuota drops the throttling of the container, its usage is kept
+// until its window is over since it is keyed by name
+func forgetQuota(id string) {
+	quotas.Lock()
+	defer quotas.Unlock()
+	for key := range quotas.throttled {
+		if strings.HasPrefix(key, id+"/") {
+			delete(quotas.throttled, key)
+		}
+	}
+}
+
+// WatchQuotas reads the class statistics of the containers with a quota every interval,
+// changes their rates in place when a quota is used up or its window resets and saves the usage
+func WatchQuotas(interval time.Duration) {
+	for wait(interval) {
+		containers := managedContainers(func(c *docker.Container) bool { return c.Quota != (docker.Quota{}) })
+		for _, container := range containers {
+			limits, err := parseQuota(container.Quota)
+			if err != nil {
+				continue
+			}
+			if err := account(container, limits); err != nil {
+				glog.Errorf("Quota accounting failed, container: %s, veth: %s, error: %v", container.Name, container.Veth, err)
+			}
+		}
+		// Every veth is accounted before checking so containers with several networks switch at once
+		for _, container := range containers {
+			limits, err := parseQuota(container.Quota)
+			if err != nil {
+				continue
+			}
+			throttled := throttledDirections(container.Name, limits)
+			quotas.Lock()
+			last, ok := quotas.throttled[memberKey(container.ID, container.Veth)]
+			quotas.Unlock()
+			if ok && last == throttled {
+				continue
+			}
+			for i, direction := range []string{"upload", "download"} {
+				if throttled[i] && !last[i] {
+					glog.Infof("Quota exceeded, container: %s, veth: %s, direction: %s", container.Name, container.Veth, direction)
+				} else if !throttled[i] && last[i] {
+					glog.Infof("Quota restored, container: %s, veth: %s, direction: %s", container.Name, container.Veth, direction)
+				}
+			}
+			if err := updateRates(*container); err != nil {
+				glog.Errorf("updateRates failed, container: %s, id: %s, error: %v", container.Name, container.ID, err)
+			}
+		}
+		if err := saveQuotas(); err != nil {
+			glog.Errorf("Saving quota usage failed, error: %v", err)
+		}
+	}
+}
+
+// QuotaStatus is the usage of a container quota in its current window, in bytes
+type QuotaStatus struct {
+	Window            string    `json:"window"`
+	Start             time.Time `json:"start"`
+	Upload            uint64    `json:"upload"`
+	UploadQuota       uint64    `json:"uploadQuota,omitempty"`
+	UploadThrottled   bool      `json:"uploadThrottled"`
+	Download          uint64    `json:"download"`
+	DownloadQuota     uint64    `json:"downloadQuota,omitempty"`
+	DownloadThrottled bool      `json:"downloadThrottled"`
+}
+
+// getQuotaStatus returns the quota usage of the container, nil when it has no valid quota
+func getQuotaStatus(container *docker.Container) *QuotaStatus {
+	if container.Quota == (docker.Quota{}) {
+		return nil
+	}
+	limits, err := parseQuota(container.Quota)
+	if err != nil {
+		return nil
+	}
+	quotas.Lock()
+	defer quotas.Unlock()
+	u := getUsage(container.Name, limits.window, time.Now())
+	throttled := quotas.throttled[memberKey(container.ID, container.Veth)]
+	return &QuotaStatus{
+		Window:            limits.window,
+		Start:             u.Start,
+		Upload:            u.Upload,
+		UploadQuota:       limits.upload,
+		UploadThrottled:   throttled[0],
+		Download:          u.Download,
+		DownloadQuota:     limits.download,
+		DownloadThrottled: throttled[1],
+	}
+}
+
+// quotaMetrics collects the usage of every container with a quota
+func quotaMetrics() []metrics.Metric {
+	used := metrics.Metric{Name: "tc_docker_quota_used_bytes", Help: "Bytes transferred in the current quota window.", Type: "gauge"}
+	limit := metrics.Metric{Name: "tc_docker_quota_limit_bytes", Help: "Bytes allowed per quota window.", Type: "gauge"}
+	throttled := metrics.Metric{Name: "tc_docker_quota_throttled", Help: "Whether the container is limited to its penalty rate.", Type: "gauge"}
+	seen := make(map[string]bool)
+	containers := managedContainers(func(c *docker.Container) bool { return c.Quota != (docker.Quota{}) })
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Name < containers[j].Name })
+	for _, container := range containers {
+		status := getQuotaStatus(container)
+		if status == nil || seen[container.Name] {
+			continue
+		}
+		seen[container.Name] = true
+		for _, d := range []struct {
+			direction string
+			used      uint64
+			quota     uint64
+			throttled bool
+		}{
+			{"upload", status.Upload, status.UploadQuota, status.UploadThrottled},
+			{"download", status.Download, status.DownloadQuota, status.DownloadThrottled},
+		} {
+			if d.quota == 0 {
+				continue
+			}
+			labels := map[string]string{"container": container.Name, "direction": d.direction}
+			used.Samples = append(used.Samples, metrics.Sample{Labels: labels, Value: float64(d.used)})
+			limit.Samples = append(limit.Samples, metrics.Sample{Labels: labels, Value: float64(d.quota)})
+			value := 0.0
+			if d.throttled {
+				value = 1
+			}
+			throttled.Samples = append(throttled.Samples, metrics.Sample{Labels: labels, Value: value})
+		}
+	}
+	return []metrics.Metric{used, limit, throttled}
+}
@@ -0,0 +1,86 @@
+package tc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+func TestQuotaWindowStart(t *testing.T) {
+	// 2024-01-03 is a Wednesday
+	now := time.Date(2024, 1, 3, 15, 47, 12, 0, time.UTC)
+	tests := []struct {
+		window string
+		want   time.Time
+		ok     bool
+	}{
+		{"day", time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC), true},
+		{"week", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"month", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"12h", time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC), true},
+		{"30m", time.Date(2024, 1, 3, 15, 30, 0, 0, time.UTC), true},
+		{"0s", time.Time{}, false},
+		{"-1h", time.Time{}, false},
+		{"year", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, err := quotaWindowStart(tt.window, now)
+		if (err == nil) != tt.ok {
+			t.Errorf("quotaWindowStart(%q) error = %v, want ok %t", tt.window, err, tt.ok)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("quotaWindowStart(%q) = %s, want %s", tt.window, got, tt.want)
+		}
+	}
+}
+
+func TestQuotaWindowStartWeek(t *testing.T) {
+	// Weeks start on monday, sunday belongs to the week started six days before
+	tests := []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 1, 7, 23, 59, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC), time.Date(2024, 2, 26, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := quotaWindowStart("week", tt.now)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("quotaWindowStart(week, %s) = %s, %v, want %s", tt.now, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseQuota(t *testing.T) {
+	tests := []struct {
+		quota    docker.Quota
+		upload   uint64
+		download uint64
+		window   string
+		ok       bool
+	}{
+		{docker.Quota{Upload: "10GB", UploadPenalty: "1mbit"}, 10e9, 0, "day", true},
+		{docker.Quota{Download: "512MiB", DownloadPenalty: "1mbit", Window: "week"}, 0, 512 << 20, "week", true},
+		{docker.Quota{Upload: "1GB", UploadPenalty: "1mbit", Download: "2GB", DownloadPenalty: "2mbit", Window: "6h"}, 1e9, 2e9, "6h", true},
+		{docker.Quota{Upload: "10GB"}, 0, 0, "", false},
+		{docker.Quota{Download: "0", DownloadPenalty: "1mbit"}, 0, 0, "", false},
+		{docker.Quota{Upload: "lots", UploadPenalty: "1mbit"}, 0, 0, "", false},
+		{docker.Quota{Upload: "1GB", UploadPenalty: "1mbit", Window: "fortnight"}, 0, 0, "", false},
+	}
+	for _, tt := range tests {
+		limits, err := parseQuota(tt.quota)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseQuota(%+v) error = %v, want ok %t", tt.quota, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if limits.upload != tt.upload || limits.download != tt.download || limits.window != tt.window {
+			t.Errorf("parseQuota(%+v) = %+v", tt.quota, limits)
+		}
+	}
+}
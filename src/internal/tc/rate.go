@@ -0,0 +1,137 @@
+package tc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// rateUnits maps tc rate units to their value in bits per second, tc reads rates without unit as bytes per second
+var rateUnits = map[string]float64{
+	"":      8,
+	"bit":   1,
+	"kbit":  1e3,
+	"mbit":  1e6,
+	"gbit":  1e9,
+	"tbit":  1e12,
+	"kibit": 1 << 10,
+	"mibit": 1 << 20,
+	"gibit": 1 << 30,
+	"tibit": 1 << 40,
+	"bps":   8,
+	"kbps":  8e3,
+	"mbps":  8e6,
+	"gbps":  8e9,
+	"tbps":  8e12,
+	"kibps": 8 << 10,
+	"mibps": 8 << 20,
+	"gibps": 8 << 30,
+	"tibps": 8 << 40,
+}
+
+// sizeUnits maps size units to their value in bytes
+var sizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1e3,
+	"kb":  1e3,
+	"m":   1e6,
+	"mb":  1e6,
+	"g":   1e9,
+	"gb":  1e9,
+	"t":   1e12,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// timeUnits maps tc time units to their value in nanoseconds, tc reads times without unit as microseconds
+var timeUnits = map[string]float64{
+	"":      1e3,
+	"s":     1e9,
+	"sec":   1e9,
+	"secs":  1e9,
+	"ms":    1e6,
+	"msec":  1e6,
+	"msecs": 1e6,
+	"us":    1e3,
+	"usec":  1e3,
+	"usecs": 1e3,
+	"ns":    1,
+	"nsec":  1,
+	"nsecs": 1,
+}
+
+// parseRate converts a tc rate string to bits per second
+func parseRate(s string) (uint64, error) {
+	v, ok := parseUnits(s, rateUnits)
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return v, nil
+}
+
+// parseSize converts a size such as 10GB or 512MiB to bytes
+func parseSize(s string) (uint64, error) {
+	v, ok := parseUnits(s, sizeUnits)
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v, nil
+}
+
+// parseTime converts a tc time such as 10ms or 500us to nanoseconds
+func parseTime(s string) (uint64, error) {
+	v, ok := parseUnits(s, timeUnits)
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return v, nil
+}
+
+// parseUnits converts a number followed by one of units
+func parseUnits(s string, units map[string]float64) (uint64, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := units[s[i:]]
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, false
+	}
+	return uint64(v * unit), true
+}
+
+func formatRate(bps uint64) string {
+	return fmt.Sprintf("%dbit", bps)
+}
+
+// minRate returns the lowest of the given rates, rates that cannot be parsed are ignored.
+// If none of them can be parsed the first one is returned.
+func minRate(rates ...string) string {
+	var min uint64
+	var minString string
+	for _, r := range rates {
+		v, err := parseRate(r)
+		if err != nil {
+			continue
+		}
+		if minString == "" || v < min {
+			min = v
+			minString = r
+		}
+	}
+	if minString == "" && len(rates) > 0 {
+		return rates[0]
+	}
+	return minString
+}
@@ -0,0 +1,115 @@
+package tc
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate string
+		bps  uint64
+		ok   bool
+	}{
+		{"1000000", 8000000, true},
+		{"100bit", 100, true},
+		{"10kbit", 10000, true},
+		{"10mbit", 10000000, true},
+		{"1gbit", 1000000000, true},
+		{"1kibit", 1024, true},
+		{"10mbps", 80000000, true},
+		{"1mibps", 8 << 20, true},
+		{"10Mbit", 10000000, true},
+		{" 10mbit ", 10000000, true},
+		{"1.5mbit", 1500000, true},
+		{"10%", 0, false},
+		{"10furlongs", 0, false},
+		{"mbit", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		bps, err := parseRate(tt.rate)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseRate(%q) error = %v, want ok %t", tt.rate, err, tt.ok)
+			continue
+		}
+		if bps != tt.bps {
+			t.Errorf("parseRate(%q) = %d, want %d", tt.rate, bps, tt.bps)
+		}
+	}
+}
+
+func TestMinRate(t *testing.T) {
+	tests := []struct {
+		rates []string
+		min   string
+	}{
+		{[]string{"10mbit", "1mbit", "5mbit"}, "1mbit"},
+		{[]string{"1mbps", "10mbit"}, "1mbps"},
+		{[]string{"bad", "2mbit"}, "2mbit"},
+		{[]string{"bad", "worse"}, "bad"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if min := minRate(tt.rates...); min != tt.min {
+			t.Errorf("minRate(%v) = %q, want %q", tt.rates, min, tt.min)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		time string
+		ns   uint64
+		ok   bool
+	}{
+		{"10ms", 10000000, true},
+		{"1.5s", 1500000000, true},
+		{"800us", 800000, true},
+		{"800usecs", 800000, true},
+		{"100", 100000, true},
+		{"250ns", 250, true},
+		{"10MS", 10000000, true},
+		{"10min", 0, false},
+		{"soon", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		ns, err := parseTime(tt.time)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseTime(%q) error = %v, want ok %t", tt.time, err, tt.ok)
+			continue
+		}
+		if ns != tt.ns {
+			t.Errorf("parseTime(%q) = %d, want %d", tt.time, ns, tt.ns)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size  string
+		bytes uint64
+		ok    bool
+	}{
+		{"1500", 1500, true},
+		{"100b", 100, true},
+		{"10GB", 10e9, true},
+		{"10g", 10e9, true},
+		{"1.5kb", 1500, true},
+		{"512MiB", 512 << 20, true},
+		{"1TiB", 1 << 40, true},
+		{" 2mb ", 2e6, true},
+		{"10mbit", 0, false},
+		{"GB", 0, false},
+		{"-1GB", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		bytes, err := parseSize(tt.size)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseSize(%q) error = %v, want ok %t", tt.size, err, tt.ok)
+			continue
+		}
+		if bytes != tt.bytes {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.size, bytes, tt.bytes)
+		}
+	}
+}
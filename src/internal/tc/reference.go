@@ -0,0 +1,182 @@
+package tc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+// isPercentage reports whether rate is relative to a reference bandwidth, e.g. 70.5%
+func isPercentage(rate string) bool {
+	return strings.HasSuffix(strings.TrimSpace(rate), "%")
+}
+
+// resolveRate converts a percentage rate to an absolute one using reference,
+// absolute rates are returned untouched
+func resolveRate(rate string, reference func() (uint64, error)) (string, error) {
+	if !isPercentage(rate) {
+		return rate, nil
+	}
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(rate), "%"), 64)
+	if err != nil || pct <= 0 || pct > 100 {
+		return "", fmt.Errorf("invalid rate %q, percentages must be between 0 and 100", rate)
+	}
+	ref, err := reference()
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve rate %q: %v", rate, err)
+	}
+	return formatRate(uint64(float64(ref) * pct / 100)), nil
+}
+
+// hostReference returns the host bandwidth budget in bits per second, either the
+// configured reference rate or the speed of the reference interface
+func hostReference() (uint64, error) {
+	if global.Conf.Reference.Rate != "" {
+		return parseRate(global.Conf.Reference.Rate)
+	}
+	iface := global.Conf.Reference.Interface
+	if iface == "" {
+		var err error
+		iface, err = defaultRouteInterface()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return linkSpeed(iface)
+}
+
+// linkSpeed reads the negotiated speed of iface from sysfs, the same value reported by ethtool
+func linkSpeed(iface string) (uint64, error) {
+	b, err := ioutil.ReadFile("/sys/class/net/" + iface + "/speed")
+	if err != nil {
+		return 0, fmt.Errorf("cannot read speed of %s: %v", iface, err)
+	}
+	speed, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("interface %s does not report its speed, set reference.rate in config", iface)
+	}
+	return uint64(speed) * 1e6, nil
+}
+
+// defaultRouteInterface returns the interface of the IPv4 default route
+func defaultRouteInterface() (string, error) {
+	b, err := ioutil.ReadFile("/proc/net/route")
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[1] == "00000000" {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no default route found, set reference.interface in config")
+}
+
+// poolReference returns the reference of pool members for one direction, the pool rate itself
+func poolReference(name string, download bool) func() (uint64, error) {
+	return func() (uint64, error) {
+		limits, ok := global.Conf.Pools[name]
+		if !ok {
+			return 0, fmt.Errorf("pool %s is not defined in config", name)
+		}
+		rate := limits.Upload.Rate
+		if download {
+			rate = limits.Download.Rate
+		}
+		rate, err := resolveRate(rate, hostReference)
+		if err != nil {
+			return 0, err
+		}
+		return parseRate(rate)
+	}
+}
+
+// resolveRates replaces percentage rates and ceils of container by absolute values
+func resolveRates(container *docker.Container) error {
+	upload, download := hostReference, hostReference
+	if container.Pool != "" {
+		upload, download = poolReference(container.Pool, false), poolReference(container.Pool, true)
+	}
+	for _, r := range []struct {
+		rate      *string
+		reference func() (uint64, error)
+	}{
+		{&container.UploadRate, upload},
+		{&container.UploadCeil, upload},
+		{&container.DownloadRate, download},
+		{&container.DownloadCeil, download},
+	} {
+		resolved, err := resolveRate(*r.rate, r.reference)
+		if err != nil {
+			return err
+		}
+		*r.rate = resolved
+	}
+	return nil
+}
+
+// WatchReference periodically checks the host reference bandwidth and updates the
+// rates of every container whose limits are percentages or in a pool when it changes
+func WatchReference(interval time.Duration) {
+	// last is only known once a read succeeded, the first one sets it without applying anything
+	last, err := hostReference()
+	known := err == nil
+	for wait(interval) {
+		current, err := hostReference()
+		if err != nil {
+			continue
+		}
+		if !known {
+			last, known = current, true
+			continue
+		}
+		if current == last {
+			continue
+		}
+		glog.Infof("Reference bandwidth changed from %s to %s, applying percentage limits again", formatRate(last), formatRate(current))
+		last = current
+		// The limits are resolved under the lock, tc runs on copies so joins and leaves are not held up
+		pools.Lock()
+		var resolved []pool
+		for _, p := range pools.m {
+			p.limits = resolvePool(p.name)
+			resolved = append(resolved, *p)
+		}
+		pools.Unlock()
+		for _, p := range resolved {
+			if err := p.applyLimits("change"); err != nil {
+				glog.Errorf("WatchReference, pool: %s, error: %v", p.name, err)
+			}
+		}
+		for _, container := range managedContainers(func(c *docker.Container) bool {
+			return c.Pool != "" || isPercentage(c.UploadRate) || isPercentage(c.UploadCeil) ||
+				isPercentage(c.DownloadRate) || isPercentage(c.DownloadCeil)
+		}) {
+			if err := updateRates(*container); err != nil {
+				glog.Errorf("updateRates failed, container: %s, id: %s, error: %v", container.Name, container.ID, err)
+			}
+		}
+	}
+}
+
+// resolvePool returns the pool limits with percentages resolved against the host reference.
+// Limits that cannot be resolved are kept as is and will be reported when used.
+func resolvePool(name string) global.Pool {
+	limits := global.Conf.Pools[name]
+	for _, rate := range []*string{&limits.Upload.Rate, &limits.Upload.Ceil, &limits.Download.Rate, &limits.Download.Ceil} {
+		if resolved, err := resolveRate(*rate, hostReference); err == nil {
+			*rate = resolved
+		}
+	}
+	return limits
+}
@@ -0,0 +1,37 @@
+package tc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolveRate(t *testing.T) {
+	gbit := func() (uint64, error) { return 1000000000, nil }
+	broken := func() (uint64, error) { return 0, errors.New("no speed") }
+	tests := []struct {
+		rate      string
+		reference func() (uint64, error)
+		want      string
+		ok        bool
+	}{
+		{"10mbit", broken, "10mbit", true},
+		{"", broken, "", true},
+		{"50%", gbit, "500000000bit", true},
+		{" 70.5% ", gbit, "705000000bit", true},
+		{"100%", gbit, "1000000000bit", true},
+		{"0%", gbit, "", false},
+		{"101%", gbit, "", false},
+		{"half%", gbit, "", false},
+		{"50%", broken, "", false},
+	}
+	for _, tt := range tests {
+		got, err := resolveRate(tt.rate, tt.reference)
+		if (err == nil) != tt.ok {
+			t.Errorf("resolveRate(%q) error = %v, want ok %t", tt.rate, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("resolveRate(%q) = %q, want %q", tt.rate, got, tt.want)
+		}
+	}
+}
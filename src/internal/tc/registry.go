@@ -0,0 +1,183 @@
+package tc
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+// managed keeps, for every veth tc-docker has shaped, the container as read from its labels
+// so limits can be computed and applied again when something they depend on changes,
+// along with the container as it was last applied
+var managed = struct {
+	sync.Mutex
+	m map[string]*managedContainer
+}{m: make(map[string]*managedContainer)}
+
+type managedContainer struct {
+	labels  docker.Container
+	applied docker.Container
+}
+
+func remember(labels, applied docker.Container) {
+	managed.Lock()
+	managed.m[memberKey(labels.ID, labels.Veth)] = &managedContainer{labels: labels, applied: applied}
+	managed.Unlock()
+
+	failures.Lock()
+	delete(failures.m, labels.ID)
+	failures.Unlock()
+}
+
+// failures keeps the last error of the containers tc-docker gave up shaping, keyed by ID
+var failures = struct {
+	sync.Mutex
+	m map[string]ContainerStatus
+}{m: make(map[string]ContainerStatus)}
+
+// RecordFailure marks the container as failed in the status until it is shaped or released
+func RecordFailure(id, name string, err error) {
+	failures.Lock()
+	status := ContainerStatus{Name: name, ID: id, Error: err.Error()}
+	if previous, ok := failures.m[id]; ok {
+		status.Conflict = previous.Conflict
+	}
+	failures.m[id] = status
+	failures.Unlock()
+}
+
+// recordConflict shows the container as failed in the status as soon as it runs into a foreign qdisc
+func recordConflict(container *docker.Container, err *ForeignQdiscError) {
+	failures.Lock()
+	failures.m[container.ID] = ContainerStatus{Name: container.Name, ID: container.ID, Error: err.Error(), Conflict: err.Dev + " " + err.Parent + " " + err.Qdisc}
+	failures.Unlock()
+}
+
+// rememberApplied records the limits currently in force on a managed container
+func rememberApplied(applied docker.Container) {
+	managed.Lock()
+	if mc, ok := managed.m[memberKey(applied.ID, applied.Veth)]; ok {
+		mc.applied = applied
+	}
+	managed.Unlock()
+}
+
+// managedContainers returns a copy of every managed container accepted by filter
+func managedContainers(filter func(*docker.Container) bool) []*docker.Container {
+	managed.Lock()
+	defer managed.Unlock()
+	var containers []*docker.Container
+	for _, mc := range managed.m {
+		container := mc.labels
+		if filter(&container) {
+			containers = append(containers, &container)
+		}
+	}
+	return containers
+}
+
+// Managed returns the labels of every managed veth
+func Managed() []docker.Container {
+	managed.Lock()
+	defer managed.Unlock()
+	var containers []docker.Container
+	for _, mc := range managed.m {
+		containers = append(containers, mc.labels)
+	}
+	return containers
+}
+
+// managedVeths returns the labels of every veth of the named container, host network
+// containers have no veth and are left out
+func managedVeths(name string) []docker.Container {
+	managed.Lock()
+	defer managed.Unlock()
+	var veths []docker.Container
+	for _, mc := range managed.m {
+		if mc.labels.Name == name && mc.labels.Cgroup == "" {
+			veths = append(veths, mc.labels)
+		}
+	}
+	sort.Slice(veths, func(i, j int) bool { return veths[i].Veth < veths[j].Veth })
+	return veths
+}
+
+// sharesHostNetwork tells whether the named container is shaped on the uplink
+func sharesHostNetwork(name string) bool {
+	managed.Lock()
+	defer managed.Unlock()
+	for _, mc := range managed.m {
+		if mc.labels.Name == name && mc.labels.Cgroup != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// LeaveNetns removes a dead container from the members of the network namespace it was shaped in,
+// it returns the container the namespace is shaped as and how many members are left. ok is false
+// when the container is not a member of any managed namespace.
+func LeaveNetns(id string) (owner docker.Container, remaining int, ok bool) {
+	managed.Lock()
+	defer managed.Unlock()
+	for _, mc := range managed.m {
+		members := removeMember(mc.labels.Members, id)
+		if len(members) == len(mc.labels.Members) {
+			continue
+		}
+		mc.labels.Members = members
+		mc.applied.Members = members
+		owner, remaining, ok = mc.labels, len(members), true
+	}
+	return owner, remaining, ok
+}
+
+func removeMember(members []string, id string) []string {
+	var left []string
+	for _, member := range members {
+		if member != id {
+			left = append(left, member)
+		}
+	}
+	return left
+}
+
+// Release forgets the container and removes it from every shared tree it was part of
+func Release(id string) error {
+	managed.Lock()
+	var released []docker.Container
+	for key, mc := range managed.m {
+		if mc.labels.ID == id {
+			released = append(released, mc.labels)
+			delete(managed.m, key)
+		}
+	}
+	managed.Unlock()
+	for _, container := range released {
+		forgetQdiscs(container)
+	}
+
+	failures.Lock()
+	delete(failures.m, id)
+	failures.Unlock()
+
+	scheduled.Lock()
+	for key := range scheduled.m {
+		if strings.HasPrefix(key, id+"/") {
+			delete(scheduled.m, key)
+		}
+	}
+	scheduled.Unlock()
+	forgetQuota(id)
+	forgetCredits(id)
+	forgetCounters(id)
+
+	for _, leave := range []func(string) error{LeavePool, LeaveBridges, leaveTopology, leaveUplink} {
+		if err := leave(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package tc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+// A window overrides the container limits on some days between two times of the day,
+// it is written as "<days> <from>-<to> <limit>=<rate>...", e.g. "mon-fri 08:00-20:00 upload=50mbit".
+// Windows whose end is before their start finish on the next day.
+type window struct {
+	spec     string
+	days     [7]bool
+	from     int
+	to       int
+	upload   global.Limit
+	download global.Limit
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// scheduled keeps the window applied to each managed veth, -1 when none is active
+var scheduled = struct {
+	sync.Mutex
+	m map[string]int
+}{m: make(map[string]int)}
+
+// getSchedule returns the windows of the schedule label, either a schedule name from the config or inline windows separated by ;
+func getSchedule(schedule string) ([]window, error) {
+	specs, ok := global.Conf.Schedules[schedule]
+	if !ok {
+		specs = strings.Split(schedule, ";")
+	}
+	var windows []window
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		w, err := parseWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %v", schedule, err)
+		}
+		windows = append(windows, w)
+	}
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("schedule %q has no windows", schedule)
+	}
+	return windows, nil
+}
+
+func parseWindow(spec string) (window, error) {
+	w := window{spec: strings.TrimSpace(spec)}
+	fields := strings.Fields(spec)
+	if len(fields) < 3 {
+		return w, fmt.Errorf("invalid window %q, expected <days> <from>-<to> <limit>=<rate>", spec)
+	}
+	if err := parseDays(fields[0], &w.days); err != nil {
+		return w, err
+	}
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return w, fmt.Errorf("invalid window time range %q", fields[1])
+	}
+	var err error
+	if w.from, err = parseTimeOfDay(times[0]); err != nil {
+		return w, err
+	}
+	if w.to, err = parseTimeOfDay(times[1]); err != nil {
+		return w, err
+	}
+	for _, field := range fields[2:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return w, fmt.Errorf("invalid window limit %q", field)
+		}
+		switch kv[0] {
+		case "upload", "upload.rate":
+			w.upload.Rate = kv[1]
+		case "upload.ceil":
+			w.upload.Ceil = kv[1]
+		case "download", "download.rate":
+			w.download.Rate = kv[1]
+		case "download.ceil":
+			w.download.Ceil = kv[1]
+		default:
+			return w, fmt.Errorf("invalid window limit %q, must be one of upload, upload.ceil, download or download.ceil", kv[0])
+		}
+	}
+	return w, nil
+}
+
+// parseDays parses *, a day, a range of days like mon-fri or a comma separated list of both
+func parseDays(s string, days *[7]bool) error {
+	if s == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return nil
+	}
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		bounds := strings.Split(part, "-")
+		first, ok := weekdays[bounds[0]]
+		if !ok || len(bounds) > 2 {
+			return fmt.Errorf("invalid window days %q", s)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return fmt.Errorf("invalid window days %q", s)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of HH:MM
+func parseTimeOfDay(s string) (int, error) {
+	hm := strings.Split(s, ":")
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	h, errH := strconv.Atoi(hm[0])
+	m, errM := strconv.Atoi(hm[1])
+	if errH != nil || errM != nil || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+func (w window) active(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	if w.from < w.to {
+		return w.days[today] && minute >= w.from && minute < w.to
+	}
+	yesterday := (today + 6) % 7
+	return (w.days[today] && minute >= w.from) || (w.days[yesterday] && minute < w.to)
+}
+
+// activeWindow returns the index of the first window active at now, or -1
+func activeWindow(windows []window, now time.Time) int {
+	for i, w := range windows {
+		if w.active(now) {
+			return i
+		}
+	}
+	return -1
+}
+
+// applySchedule overrides the container limits with the ones of its active window
+// and records the window so the watcher only acts on boundaries
+func applySchedule(container *docker.Container) error {
+	if container.Schedule == "" {
+		return nil
+	}
+	windows, err := getSchedule(container.Schedule)
+	if err != nil {
+		return err
+	}
+	i := activeWindow(windows, time.Now())
+	scheduled.Lock()
+	scheduled.m[memberKey(container.ID, container.Veth)] = i
+	scheduled.Unlock()
+	if i < 0 {
+		return nil
+	}
+	w := windows[i]
+	overrideLimit(&container.UploadRate, &container.UploadCeil, w.upload)
+	overrideLimit(&container.DownloadRate, &container.DownloadCeil, w.download)
+	return nil
+}
+
+// overrideLimit replaces rate and ceil by the ones of limit, a rate without ceil caps both
+func overrideLimit(rate, ceil *string, limit global.Limit) {
+	if limit.Rate != "" {
+		*rate = limit.Rate
+		*ceil = limit.Rate
+	}
+	if limit.Ceil != "" {
+		*ceil = limit.Ceil
+	}
+}
+
+// WatchSchedules checks every minute the schedule of each managed container and
+// changes its rates in place when it enters or leaves a window
+func WatchSchedules() {
+	for {
+		now := time.Now()
+		if !wait(now.Truncate(time.Minute).Add(time.Minute).Sub(now)) {
+			return
+		}
+
+		for _, container := range managedContainers(func(c *docker.Container) bool { return c.Schedule != "" }) {
+			windows, err := getSchedule(container.Schedule)
+			if err != nil {
+				continue
+			}
+			i := activeWindow(windows, time.Now())
+			scheduled.Lock()
+			last, ok := scheduled.m[memberKey(container.ID, container.Veth)]
+			scheduled.Unlock()
+			if ok && last == i {
+				continue
+			}
+			if i >= 0 {
+				glog.Infof("Schedule window %q started, container: %s, veth: %s", windows[i].spec, container.Name, container.Veth)
+			} else if ok && last >= 0 {
+				glog.Infof("Schedule window %q ended, container: %s, veth: %s", windows[last].spec, container.Name, container.Veth)
+			}
+			if err := updateRates(*container); err != nil {
+				glog.Errorf("updateRates failed, container: %s, id: %s, error: %v", container.Name, container.ID, err)
+			}
+		}
+	}
+}
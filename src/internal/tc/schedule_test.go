@@ -0,0 +1,128 @@
+package tc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brenozd/tc-docker/global"
+)
+
+func TestParseWindow(t *testing.T) {
+	weekdays := [7]bool{false, true, true, true, true, true, false}
+	tests := []struct {
+		spec     string
+		days     [7]bool
+		from, to int
+		upload   global.Limit
+		download global.Limit
+		ok       bool
+	}{
+		{"mon-fri 08:00-20:00 upload=50mbit", weekdays, 8 * 60, 20 * 60, global.Limit{Rate: "50mbit"}, global.Limit{}, true},
+		{"* 22:30-06:00 download.rate=1mbit download.ceil=5mbit", [7]bool{true, true, true, true, true, true, true}, 22*60 + 30, 6 * 60, global.Limit{}, global.Limit{Rate: "1mbit", Ceil: "5mbit"}, true},
+		{"sat,SUN 00:00-24:00 upload.ceil=10% download=2mbit", [7]bool{true, false, false, false, false, false, true}, 0, 24 * 60, global.Limit{Ceil: "10%"}, global.Limit{Rate: "2mbit"}, true},
+		{"fri-mon 18:00-09:00 upload=1mbit", [7]bool{true, true, false, false, false, true, true}, 18 * 60, 9 * 60, global.Limit{Rate: "1mbit"}, global.Limit{}, true},
+		{"mon-fri 08:00-20:00", [7]bool{}, 0, 0, global.Limit{}, global.Limit{}, false},
+		{"someday 08:00-20:00 upload=1mbit", [7]bool{}, 0, 0, global.Limit{}, global.Limit{}, false},
+		{"mon-fri-sat 08:00-20:00 upload=1mbit", [7]bool{}, 0, 0, global.Limit{}, global.Limit{}, false},
+		{"mon 08:00 upload=1mbit", [7]bool{}, 0, 0, global.Limit{}, global.Limit{}, false},
+		{"mon 8-20 upload=1mbit", [7]bool{}, 0, 0, global.Limit{}, global.Limit{}, false},
+		{"mon 08:00-24:01 upload=1mbit", [7]bool{}, 0, 0, global.Limit{}, global.Limit{}, false},
+		{"mon 08:00-20:60 upload=1mbit", [7]bool{}, 0, 0, global.Limit{}, global.Limit{}, false},
+		{"mon 08:00-20:00 upload=", [7]bool{}, 0, 0, global.Limit{}, global.Limit{}, false},
+		{"mon 08:00-20:00 burst=1mbit", [7]bool{}, 0, 0, global.Limit{}, global.Limit{}, false},
+	}
+	for _, tt := range tests {
+		w, err := parseWindow(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseWindow(%q) error = %v, want ok %t", tt.spec, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if w.days != tt.days || w.from != tt.from || w.to != tt.to || w.upload != tt.upload || w.download != tt.download {
+			t.Errorf("parseWindow(%q) = %+v", tt.spec, w)
+		}
+	}
+}
+
+func TestWindowActive(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		spec string
+		now  time.Time
+		want bool
+	}{
+		{"mon-fri 08:00-20:00 upload=1mbit", at(1, 8, 0), true},
+		{"mon-fri 08:00-20:00 upload=1mbit", at(1, 19, 59), true},
+		{"mon-fri 08:00-20:00 upload=1mbit", at(1, 20, 0), false},
+		{"mon-fri 08:00-20:00 upload=1mbit", at(1, 7, 59), false},
+		{"mon-fri 08:00-20:00 upload=1mbit", at(6, 12, 0), false},
+		{"fri 22:00-06:00 upload=1mbit", at(5, 23, 0), true},
+		{"fri 22:00-06:00 upload=1mbit", at(6, 5, 59), true},
+		{"fri 22:00-06:00 upload=1mbit", at(6, 6, 0), false},
+		{"fri 22:00-06:00 upload=1mbit", at(5, 5, 0), false},
+		{"sun 00:00-24:00 upload=1mbit", at(7, 23, 59), true},
+		{"sun 00:00-24:00 upload=1mbit", at(8, 0, 0), false},
+		{"mon 00:00-00:00 upload=1mbit", at(1, 12, 0), true},
+		{"mon 00:00-00:00 upload=1mbit", at(2, 12, 0), false},
+	}
+	for _, tt := range tests {
+		w, err := parseWindow(tt.spec)
+		if err != nil {
+			t.Fatalf("parseWindow(%q) error = %v", tt.spec, err)
+		}
+		if got := w.active(tt.now); got != tt.want {
+			t.Errorf("window %q active at %s = %t, want %t", tt.spec, tt.now.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestActiveWindow(t *testing.T) {
+	var windows []window
+	for _, spec := range []string{"mon 08:00-12:00 upload=1mbit", "mon 10:00-14:00 upload=2mbit"} {
+		w, err := parseWindow(spec)
+		if err != nil {
+			t.Fatalf("parseWindow(%q) error = %v", spec, err)
+		}
+		windows = append(windows, w)
+	}
+	tests := []struct {
+		hour int
+		want int
+	}{
+		{7, -1},
+		{9, 0},
+		{11, 0},
+		{13, 1},
+		{14, -1},
+	}
+	for _, tt := range tests {
+		now := time.Date(2024, 1, 1, tt.hour, 0, 0, 0, time.Local)
+		if got := activeWindow(windows, now); got != tt.want {
+			t.Errorf("activeWindow at %02d:00 = %d, want %d", tt.hour, got, tt.want)
+		}
+	}
+}
+
+func TestOverrideLimit(t *testing.T) {
+	tests := []struct {
+		limit      global.Limit
+		rate, ceil string
+	}{
+		{global.Limit{}, "10mbit", "100mbit"},
+		{global.Limit{Rate: "1mbit"}, "1mbit", "1mbit"},
+		{global.Limit{Ceil: "50mbit"}, "10mbit", "50mbit"},
+		{global.Limit{Rate: "1mbit", Ceil: "5mbit"}, "1mbit", "5mbit"},
+	}
+	for _, tt := range tests {
+		rate, ceil := "10mbit", "100mbit"
+		overrideLimit(&rate, &ceil, tt.limit)
+		if rate != tt.rate || ceil != tt.ceil {
+			t.Errorf("overrideLimit(%+v) = %s, %s, want %s, %s", tt.limit, rate, ceil, tt.rate, tt.ceil)
+		}
+	}
+}
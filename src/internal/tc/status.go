@@ -0,0 +1,90 @@
+package tc
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/brenozd/tc-docker/internal/metrics"
+)
+
+// ContainerStatus is a managed veth with the limits currently in force on it
+type ContainerStatus struct {
+	Name         string        `json:"name"`
+	ID           string        `json:"id"`
+	Veth         string        `json:"veth"`
+	Ifb          string        `json:"ifb"`
+	Pool         string        `json:"pool,omitempty"`
+	Members      []string      `json:"members,omitempty"`
+	UploadRate   string        `json:"uploadRate"`
+	UploadCeil   string        `json:"uploadCeil"`
+	DownloadRate string        `json:"downloadRate"`
+	DownloadCeil string        `json:"downloadCeil"`
+	Quota        *QuotaStatus  `json:"quota,omitempty"`
+	Credits      *CreditStatus `json:"credits,omitempty"`
+	// Priority and Weight are in force on Bridges, for the traffic crossing the bridge devices only
+	Priority string   `json:"priority,omitempty"`
+	Weight   string   `json:"weight,omitempty"`
+	Bridges  []string `json:"bridges,omitempty"`
+	// Error is why the container could not be shaped, its limits are empty then
+	Error string `json:"error,omitempty"`
+	// Conflict is the foreign qdisc that kept the container from being shaped, if any
+	Conflict string `json:"conflict,omitempty"`
+}
+
+// Status returns every managed veth, and every container that could not be shaped,
+// sorted by container name and veth
+func Status() []ContainerStatus {
+	managed.Lock()
+	var entries []managedContainer
+	for _, mc := range managed.m {
+		entries = append(entries, *mc)
+	}
+	managed.Unlock()
+
+	var list []ContainerStatus
+	for _, mc := range entries {
+		c := mc.applied
+		// Members are only listed for network namespaces shared by several containers
+		var members []string
+		if len(c.Members) > 1 {
+			members = c.Members
+		}
+		list = append(list, ContainerStatus{
+			Name:         c.Name,
+			ID:           c.ID,
+			Veth:         c.Veth,
+			Ifb:          c.Ifb,
+			Pool:         c.Pool,
+			Members:      members,
+			UploadRate:   c.UploadRate,
+			UploadCeil:   c.UploadCeil,
+			DownloadRate: c.DownloadRate,
+			DownloadCeil: c.DownloadCeil,
+			Quota:        getQuotaStatus(&mc.labels),
+			Credits:      getCreditStatus(&mc.labels),
+		})
+		if bridges := prioritizedOn(c.ID); len(bridges) > 0 {
+			priority, weight, _ := parsePriority(&c)
+			status := &list[len(list)-1]
+			status.Priority, status.Weight, status.Bridges = strconv.Itoa(priority), strconv.Itoa(weight), bridges
+		}
+	}
+	failures.Lock()
+	for _, failure := range failures.m {
+		list = append(list, failure)
+	}
+	failures.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Veth < list[j].Veth
+	})
+	return list
+}
+
+// Metrics collects the metrics of the managed containers
+func Metrics() []metrics.Metric {
+	return append(quotaMetrics(), creditMetrics()...)
+}
@@ -4,69 +4,125 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
 	"github.com/brenozd/tc-docker/internal/docker"
 	"github.com/brenozd/tc-docker/pkg/command"
+	"github.com/brenozd/tc-docker/pkg/netns"
 )
 
 var (
 	ErrTcNotFound = errors.New("RTNETLINK answers: No such file or directory")
+	// ErrTcNoQdisc is what newer iproute2 answers when deleting the default qdisc of a device
+	ErrTcNoQdisc = errors.New("Error: Cannot delete qdisc with handle of zero.")
 )
 
+// SetTC shapes container.Veth and container.Ifb according to the container labels,
+// container limits are replaced by the ones in force, e.g. from its schedule, with
+// percentage rates resolved to absolute values.
+// Containers with a Netns are shaped on their own interface inside it, host network
+// containers, with a Cgroup, on the host uplink.
 func SetTC(container *docker.Container) error {
-	// Delete any existing root qdisc in container.Veth
-	cmd := fmt.Sprintf("/usr/sbin/tc qdisc del dev %s root", container.Veth)
-	glog.Debug(cmd)
-	out, err := command.CombinedOutput(cmd)
-	if err != nil {
-		if strings.TrimSpace(string(out)) != ErrTcNotFound.Error() {
-			return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+	labels := *container
+	hostVeth := container.Netns == "" && container.Cgroup == ""
+	if !hostVeth {
+		if err := checkVethLimits(container); err != nil {
+			return err
 		}
 	}
-
-	// Create HTB qdisc to limit egress traffic in container.Veth
-	cmd = fmt.Sprintf("/usr/sbin/tc qdisc add dev %s root handle 1: htb r2q 1 default 2", container.Veth)
-	glog.Debug(cmd)
-	out, err = command.CombinedOutput(cmd)
-	if err != nil {
-		return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+	if err := applyPolicies(container); err != nil {
+		return err
+	}
+	var err error
+	if container.Cgroup != "" {
+		err = joinUplink(container)
+	} else {
+		err = inNetns(container, func() error { return setTC(container) })
+	}
+	if foreign, ok := err.(*ForeignQdiscError); ok {
+		recordConflict(container, foreign)
 	}
-
-	// Set egress bandwidth limit
-	cmd = fmt.Sprintf("/usr/sbin/tc class add dev %s parent 1: classid 1:2 htb rate %s ceil %s prio 2", container.Veth, container.UploadRate, container.UploadCeil)
-	glog.Debug(cmd)
-	out, err = command.CombinedOutput(cmd)
 	if err != nil {
-		return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+		return err
 	}
+	remember(labels, *container)
+	if container.Cgroup != "" {
+		return nil
+	}
+	return applyPartitions(container)
+}
 
-	netemFlags := "delay " + container.LatencyDelay
-
-	if container.LatencyDelay != "0ms" && container.LatencyVariation != "" {
-		netemFlags += " " + container.LatencyVariation
-		if container.LatencyCorrelation != "" {
-			netemFlags += " " + container.LatencyCorrelation
+// checkVethLimits rejects the limits that need the host side of a veth, partitions
+// only need a veth and are rejected for host network containers only
+func checkVethLimits(container *docker.Container) error {
+	for _, l := range []struct{ label, value string }{
+		{"pool", container.Pool},
+		{"region", container.Region},
+	} {
+		if l.value != "" {
+			return fmt.Errorf("%s is only supported on bridge networks", l.label)
 		}
 	}
+	if container.Cgroup == "" {
+		return nil
+	}
+	if container.Partition != "" {
+		return fmt.Errorf("partition is not supported on the host network")
+	}
+	// Host network containers have no device their download could be shaped on
+	if container.DownloadRate != docker.DefaultRate || container.DownloadCeil != docker.DefaultRate ||
+		container.DownloadTuning != (docker.Tuning{}) || container.Quota.Download != "" ||
+		container.Credits.DownloadBaseline != "" || container.Credits.DownloadMax != "" {
+		return fmt.Errorf("download limits are not supported on the host network")
+	}
+	return nil
+}
 
-	if container.LossProbability != "" {
-		netemFlags += " loss " + container.LossProbability
-		if container.LossCorrelation != "" {
-			netemFlags += " " + container.LossCorrelation
-		}
+// inNetns runs f inside the network namespace of the container when it is shaped there
+func inNetns(container *docker.Container, f func() error) error {
+	if container.Netns == "" {
+		return f()
+	}
+	return netns.Do(container.Netns, f)
+}
+
+func setTC(container *docker.Container) error {
+	mtu := deviceMTU(container.Veth)
+	uploadParams, err := htbClassParams(container.UploadRate, container.UploadCeil, container.UploadTuning, mtu)
+	if err != nil {
+		return fmt.Errorf("upload: %v", err)
+	}
+	uploadPolicer, err := packetRatePolicer(container.UploadTuning)
+	if err != nil {
+		return fmt.Errorf("upload: %v", err)
+	}
+	downloadParams, err := htbClassParams(container.DownloadRate, container.DownloadCeil, container.DownloadTuning, mtu)
+	if err != nil {
+		return fmt.Errorf("download: %v", err)
+	}
+	downloadPolicer, err := packetRatePolicer(container.DownloadTuning)
+	if err != nil {
+		return fmt.Errorf("download: %v", err)
 	}
 
-	if container.PacketDuplication != "" {
-		netemFlags += " duplicate " + container.PacketDuplication
+	// Replace the root qdisc in container.Veth by an HTB qdisc to limit egress traffic
+	if err := replaceQdisc(container.Netns, container.Veth, "root", "1:", "htb default 2"); err != nil {
+		return err
 	}
 
-	if container.PacketCorruption != "" {
-		netemFlags += " corrupt " + container.PacketCorruption
+	// Set egress bandwidth limit
+	cmd := fmt.Sprintf("/usr/sbin/tc class add dev %s parent 1: classid 1:2 htb rate %s ceil %s prio 2 %s", container.Veth, container.UploadRate, container.UploadCeil, uploadParams)
+	glog.Debug(cmd)
+	out, err := command.CombinedOutput(cmd)
+	if err != nil {
+		return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
 	}
 
-	if container.PacketReordering != "" {
-		netemFlags += " reorder " + container.PacketReordering
+	netemFlags, err := getNetemFlags(container)
+	if err != nil {
+		return err
 	}
 
 	// Set netem
@@ -77,38 +133,54 @@ func SetTC(container *docker.Container) error {
 		return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
 	}
 
+	var p *pool
+	var member *poolMember
+	if container.Pool != "" {
+		p, member, err = joinPool(container)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Apply to all traffic going through container.Veth
 	cmd = fmt.Sprintf("/usr/sbin/tc filter add dev %s parent 1:0 matchall flowid 1:2", container.Veth)
+	if uploadPolicer != "" {
+		cmd += " " + uploadPolicer
+	}
+	if member != nil {
+		// Traffic takes a round trip through the pool ifb, which hands it back already
+		// classified so it lands on the default class 1:2
+		cmd += " " + poolRedirect(member, p.upIfb)
+	}
 	glog.Debug(cmd)
 	out, err = command.CombinedOutput(cmd)
 	if err != nil {
 		return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
 	}
 
-	if container.Ifb == "" {
-		return fmt.Errorf("cannot create container.Ifb interface to limit ingress traffic")
-	}
+	// Bridges and regions live on the host, the interfaces of a container shaped in its
+	// network namespace don't go through them
+	if container.Netns == "" {
+		if err := joinBridges(container); err != nil {
+			return err
+		}
 
-	// Delete any existing root qdisc in container.Veth
-	cmd = fmt.Sprintf("/usr/sbin/tc qdisc del dev %s root", container.Ifb)
-	glog.Debug(cmd)
-	out, err = command.CombinedOutput(cmd)
-	if err != nil {
-		if strings.TrimSpace(string(out)) != ErrTcNotFound.Error() {
-			return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+		if err := joinTopology(container); err != nil {
+			return err
 		}
 	}
 
-	// Create HTB qdisc to limit egress traffic in container.Veth
-	cmd = fmt.Sprintf("/usr/sbin/tc qdisc add dev %s root handle 1: htb r2q 1", container.Ifb)
-	glog.Debug(cmd)
-	out, err = command.CombinedOutput(cmd)
-	if err != nil {
-		return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+	if container.Ifb == "" {
+		return fmt.Errorf("cannot create container.Ifb interface to limit ingress traffic")
+	}
+
+	// Replace the root qdisc in container.Ifb by an HTB qdisc to limit egress traffic
+	if err := installQdisc(container.Netns, container.Ifb, "root", "1:", "htb"); err != nil {
+		return err
 	}
 
 	// Set egress bandwidth limit
-	cmd = fmt.Sprintf("/usr/sbin/tc class add dev %s parent 1: classid 1:1 htb rate %s ceil %s", container.Ifb, container.DownloadRate, container.DownloadCeil)
+	cmd = fmt.Sprintf("/usr/sbin/tc class add dev %s parent 1: classid 1:1 htb rate %s ceil %s %s", container.Ifb, container.DownloadRate, container.DownloadCeil, downloadParams)
 	glog.Debug(cmd)
 	out, err = command.CombinedOutput(cmd)
 	if err != nil {
@@ -123,36 +195,85 @@ func SetTC(container *docker.Container) error {
 		return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
 	}
 
-	// Delete ingress qdisc in container.Veth
-	cmd = fmt.Sprintf("/usr/sbin/tc qdisc del dev %s ingress", container.Veth)
+	// Replace the ingress qdisc in container.Veth
+	if err := replaceQdisc(container.Netns, container.Veth, "ingress", "ffff:", ""); err != nil {
+		return err
+	}
+
+	// Mirror every ingress traffic from eth0 to container.Ifb0
+	redirect := fmt.Sprintf("action mirred egress redirect dev %s", container.Ifb)
+	if member != nil {
+		// Ingress cannot be redirected twice, the member class in the pool carries the download limits
+		redirect = poolRedirect(member, p.downIfb)
+	}
+	if downloadPolicer != "" {
+		redirect = downloadPolicer + " " + redirect
+	}
+	cmd = fmt.Sprintf("/usr/sbin/tc filter add dev %s ingress matchall %s", container.Veth, redirect)
 	glog.Debug(cmd)
 	out, err = command.CombinedOutput(cmd)
 	if err != nil {
-		if strings.TrimSpace(string(out)) != ErrTcNotFound.Error() {
+		if !isNotFound(out) {
 			return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
 		}
 	}
 
-	// Create ingress qdisc in container.Veth
-	cmd = fmt.Sprintf("/usr/sbin/tc qdisc add dev %s ingress", container.Veth)
+	return nil
+}
+
+// isNotFound tells whether tc failed because what it had to delete doesn't exist
+func isNotFound(out []byte) bool {
+	s := strings.TrimSpace(string(out))
+	return s == ErrTcNotFound.Error() || s == ErrTcNoQdisc.Error()
+}
+
+func run(cmd string) error {
 	glog.Debug(cmd)
-	out, err = command.CombinedOutput(cmd)
+	out, err := command.CombinedOutput(cmd)
 	if err != nil {
-		if strings.TrimSpace(string(out)) != ErrTcNotFound.Error() {
-			return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
-		}
+		return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+	}
+	return nil
+}
+
+// wait sleeps for d, it returns false instead once the daemon is stopping
+func wait(d time.Duration) bool {
+	select {
+	case <-global.Ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
 	}
+}
 
-	// Mirror every ingress traffic from eth0 to container.Ifb0
-	cmd = fmt.Sprintf("/usr/sbin/tc filter add dev %s ingress matchall action mirred egress redirect dev %s", container.Veth, container.Ifb)
+// runIgnoreNotFound runs cmd and ignores errors caused by deleting something that doesn't exist
+func runIgnoreNotFound(cmd string) error {
 	glog.Debug(cmd)
-	out, err = command.CombinedOutput(cmd)
-	if err != nil {
-		if strings.TrimSpace(string(out)) != ErrTcNotFound.Error() {
-			return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
-		}
+	out, err := command.CombinedOutput(cmd)
+	if err != nil && !isNotFound(out) {
+		return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
 	}
+	return nil
+}
 
+// lowestUnused returns the lowest value from first on that isn't used, so the class minors and filter
+// preferences of the members gone are given again instead of growing until they run out
+func lowestUnused(first int, used map[int]bool) int {
+	v := first
+	for used[v] {
+		v++
+	}
+	return v
+}
+
+// deleteFilter deletes the IP filters with preference pref of parent on dev, if there are any
+func deleteFilter(dev, parent string, pref int) error {
+	cmd := fmt.Sprintf("/usr/sbin/tc filter del dev %s parent %s protocol ip pref %d", dev, parent, pref)
+	glog.Debug(cmd)
+	out, err := command.CombinedOutput(cmd)
+	if err != nil && !strings.Contains(strings.ToLower(string(out)), "not found") && !isNotFound(out) {
+		return fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+	}
 	return nil
 }
 
@@ -162,6 +283,33 @@ func GetTcString(c *docker.Container) string {
 		c.DownloadRate, c.DownloadCeil,
 		c.UploadRate, c.UploadCeil)
 
+	if c.Netns != "" {
+		tcString += fmt.Sprintf(", netns: %s", c.Netns)
+	}
+
+	if c.Cgroup != "" {
+		tcString += fmt.Sprintf(", cgroup: %s", c.Cgroup)
+	}
+
+	if len(c.Members) > 1 {
+		tcString += fmt.Sprintf(", shared by: %s", strings.Join(c.Members, ","))
+	}
+
+	if c.Pool != "" {
+		tcString += fmt.Sprintf(", pool: %s", c.Pool)
+	}
+
+	tcString += getTuningString("upload", c.UploadTuning)
+	tcString += getTuningString("download", c.DownloadTuning)
+
+	if c.Priority != "" {
+		tcString += fmt.Sprintf(", priority: %s", c.Priority)
+	}
+
+	if c.Weight != "" {
+		tcString += fmt.Sprintf(", weight: %s", c.Weight)
+	}
+
 	if c.LatencyDelay != "0ms" {
 		tcString += fmt.Sprintf(", latency delay: %s", c.LatencyDelay)
 		if c.LatencyVariation != "" {
@@ -172,6 +320,10 @@ func GetTcString(c *docker.Container) string {
 		}
 	}
 
+	if c.LatencyDistribution != "" {
+		tcString += fmt.Sprintf(", latency distribution: %s", c.LatencyDistribution)
+	}
+
 	if c.LossProbability != "" {
 		tcString += fmt.Sprintf(", loss probability: %s", c.LossProbability)
 		if c.LossCorrelation != "" {
@@ -179,6 +331,36 @@ func GetTcString(c *docker.Container) string {
 		}
 	}
 
+	tcString += getLossModelString(c.LossModel)
+	if c.LossModel.Seed != "" {
+		tcString += fmt.Sprintf(", loss seed: %s", c.LossModel.Seed)
+	}
+
+	tcString += getNetemString(c)
+
+	if c.Schedule != "" {
+		tcString += fmt.Sprintf(", schedule: %s", c.Schedule)
+	}
+
+	if c.Quota != (docker.Quota{}) {
+		tcString += getQuotaString(c.Quota)
+	}
+
+	if c.Credits != (docker.Credits{}) {
+		tcString += getCreditsString(c.Credits)
+	}
+
+	if c.Region != "" {
+		tcString += fmt.Sprintf(", region: %s", c.Region)
+	}
+
+	if c.Partition != "" {
+		tcString += fmt.Sprintf(", partition: %s", c.Partition)
+		if c.PartitionDirection != "" {
+			tcString += fmt.Sprintf(", partition direction: %s", c.PartitionDirection)
+		}
+	}
+
 	if c.PacketDuplication != "" {
 		tcString += fmt.Sprintf(", packet duplication: %s", c.PacketDuplication)
 	}
@@ -193,3 +375,50 @@ func GetTcString(c *docker.Container) string {
 
 	return tcString
 }
+
+func getQuotaString(q docker.Quota) string {
+	var quotaString string
+	for _, p := range []struct{ name, value string }{
+		{"upload quota", q.Upload},
+		{"upload penalty", q.UploadPenalty},
+		{"download quota", q.Download},
+		{"download penalty", q.DownloadPenalty},
+		{"quota window", q.Window},
+	} {
+		if p.value != "" {
+			quotaString += fmt.Sprintf(", %s: %s", p.name, p.value)
+		}
+	}
+	return quotaString
+}
+
+func getCreditsString(c docker.Credits) string {
+	var creditsString string
+	for _, p := range []struct{ name, value string }{
+		{"upload credits baseline", c.UploadBaseline},
+		{"upload credits max", c.UploadMax},
+		{"download credits baseline", c.DownloadBaseline},
+		{"download credits max", c.DownloadMax},
+	} {
+		if p.value != "" {
+			creditsString += fmt.Sprintf(", %s: %s", p.name, p.value)
+		}
+	}
+	return creditsString
+}
+
+func getTuningString(direction string, t docker.Tuning) string {
+	var tuningString string
+	for _, p := range []struct{ name, value string }{
+		{"burst", t.Burst},
+		{"cburst", t.Cburst},
+		{"quantum", t.Quantum},
+		{"overhead", t.Overhead},
+		{"pps", t.PacketRate},
+	} {
+		if p.value != "" {
+			tuningString += fmt.Sprintf(", %s %s: %s", direction, p.name, p.value)
+		}
+	}
+	return tuningString
+}
@@ -0,0 +1,182 @@
+package tc
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/CodyGuo/glog"
+	"github.com/brenozd/tc-docker/global"
+	"github.com/brenozd/tc-docker/internal/docker"
+)
+
+const (
+	// Region classes on the veth root HTB are 1:<firstRegionMinor+i>, with a netem
+	// qdisc <firstRegionMinor+i>: below, i being the index of the source region
+	firstRegionMinor = 0x100
+	// Each region member gets its own filter preference, starting here, on the veth of every other member
+	firstTopologyPref = 1000
+)
+
+// A regionMember is a container placed in a region of the topology, traffic sent to it by other
+// members is classified by source IP into the class of the sender region on each of its veths
+type regionMember struct {
+	id     string
+	name   string
+	region string
+	ips    []string
+	pref   int
+	veths  map[string]bool
+}
+
+var topology = struct {
+	sync.Mutex
+	members map[string]*regionMember
+}{members: make(map[string]*regionMember)}
+
+func regionIndex(region string) int {
+	for i, r := range global.Conf.Topology.Regions() {
+		if r == region {
+			return i
+		}
+	}
+	return -1
+}
+
+// joinTopology builds the region classes on container.Veth, classifies the traffic of every other
+// member into them and classifies the container traffic on the veths of every other member
+func joinTopology(container *docker.Container) error {
+	if container.Region == "" {
+		return nil
+	}
+	if regionIndex(container.Region) < 0 {
+		return fmt.Errorf("region %s is not defined in topology", container.Region)
+	}
+
+	topology.Lock()
+	defer topology.Unlock()
+
+	m, ok := topology.members[container.ID]
+	if !ok {
+		m = &regionMember{id: container.ID, name: container.Name, region: container.Region, pref: freeTopologyPref(), veths: make(map[string]bool)}
+		topology.members[container.ID] = m
+	}
+	m.veths[container.Veth] = true
+	m.ips = nil
+	for _, network := range container.Networks {
+		if network.IP != "" {
+			m.ips = append(m.ips, network.IP)
+		}
+	}
+
+	for i, from := range global.Conf.Topology.Regions() {
+		link, ok := global.Conf.Topology.Link(from, m.region)
+		if !ok {
+			continue
+		}
+		bandwidth := link.Bandwidth
+		if bandwidth == "" {
+			bandwidth = container.UploadCeil
+		}
+		cmd := fmt.Sprintf("/usr/sbin/tc class add dev %s parent 1: classid 1:%x htb rate %s ceil %s", container.Veth, firstRegionMinor+i, bandwidth, bandwidth)
+		if err := run(cmd); err != nil {
+			return err
+		}
+		cmd = fmt.Sprintf("/usr/sbin/tc qdisc add dev %s parent 1:%x handle %x: netem %s", container.Veth, firstRegionMinor+i, firstRegionMinor+i, getLinkNetemFlags(link))
+		if err := run(cmd); err != nil {
+			return err
+		}
+	}
+
+	for _, other := range topology.members {
+		if other.id == m.id {
+			continue
+		}
+		if err := classifyPeer(container.Veth, m.region, other); err != nil {
+			return err
+		}
+		for veth := range other.veths {
+			if err := classifyPeer(veth, other.region, m); err != nil {
+				return err
+			}
+		}
+	}
+	glog.Debugf("joinTopology, container: %s, region: %s, ips: %v", container.Name, m.region, m.ips)
+	return nil
+}
+
+// freeTopologyPref returns the lowest filter preference no member holds, must be called with topology locked
+func freeTopologyPref() int {
+	used := make(map[int]bool)
+	for _, m := range topology.members {
+		used[m.pref] = true
+	}
+	return lowestUnused(firstTopologyPref, used)
+}
+
+// regionClasses returns the region classes joinTopology builds on the veths of a member of region
+func regionClasses(region string) []string {
+	if region == "" || regionIndex(region) < 0 {
+		return nil
+	}
+	var classes []string
+	for i, from := range global.Conf.Topology.Regions() {
+		if _, ok := global.Conf.Topology.Link(from, region); ok {
+			classes = append(classes, fmt.Sprintf("1:%x", firstRegionMinor+i))
+		}
+	}
+	return classes
+}
+
+// leaveTopology stops classifying the container traffic on the veths of the other members
+func leaveTopology(id string) error {
+	topology.Lock()
+	defer topology.Unlock()
+
+	m, ok := topology.members[id]
+	if !ok {
+		return nil
+	}
+	delete(topology.members, id)
+	for _, other := range topology.members {
+		for veth := range other.veths {
+			if err := deleteFilter(veth, "1:", m.pref); err != nil {
+				glog.Errorf("leaveTopology, container: %s, veth: %s, error: %v", m.name, veth, err)
+			}
+		}
+	}
+	return nil
+}
+
+// classifyPeer sends traffic from peer to the class of its region on veth, which belongs to a member of region.
+// Filters previously added for peer are replaced since its IPs may have changed.
+func classifyPeer(veth, region string, peer *regionMember) error {
+	if err := deleteFilter(veth, "1:", peer.pref); err != nil {
+		return err
+	}
+	if _, ok := global.Conf.Topology.Link(peer.region, region); !ok {
+		return nil
+	}
+	for _, ip := range peer.ips {
+		cmd := fmt.Sprintf("/usr/sbin/tc filter add dev %s parent 1: protocol ip pref %d u32 match ip src %s/32 flowid 1:%x",
+			veth, peer.pref, ip, firstRegionMinor+regionIndex(peer.region))
+		if err := run(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getLinkNetemFlags(link global.TopologyLink) string {
+	latency := link.Latency
+	if latency == "" {
+		latency = "0ms"
+	}
+	netemFlags := "delay " + latency
+	if link.Jitter != "" {
+		netemFlags += " " + link.Jitter
+	}
+	if link.Loss != "" {
+		netemFlags += " loss " + link.Loss
+	}
+	return netemFlags
+}
@@ -0,0 +1,135 @@
+package tc
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/brenozd/tc-docker/internal/docker"
+	"github.com/brenozd/tc-docker/pkg/command"
+)
+
+// counters holds the last byte counter read from each class by each consumer,
+// keyed by veth, consumer and direction
+var counters = struct {
+	sync.Mutex
+	m map[string]uint64
+}{m: make(map[string]uint64)}
+
+var sentBytes = regexp.MustCompile(`Sent (\d+) bytes`)
+
+// classBytes reads the bytes sent by the HTB classes of dev, summed
+func classBytes(dev string, classids ...string) (uint64, error) {
+	cmd := fmt.Sprintf("/usr/sbin/tc -s class show dev %s", dev)
+	out, err := command.CombinedOutput(cmd)
+	if err != nil {
+		return 0, fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+	}
+	sum, err := parseClassBytes(out, classids...)
+	if err != nil {
+		return 0, fmt.Errorf("cmd: %s, out: %s, error: %v", cmd, out, err)
+	}
+	return sum, nil
+}
+
+// parseClassBytes sums the bytes sent by the classes in the output of tc -s class show,
+// every class must be in it
+func parseClassBytes(out []byte, classids ...string) (uint64, error) {
+	wanted := make(map[string]bool)
+	for _, classid := range classids {
+		wanted[classid] = true
+	}
+	var sum uint64
+	var class string
+	for _, line := range strings.Split(string(out), "\n") {
+		// class htb <classid> ... heads the statistics of each class
+		if fields := strings.Fields(line); len(fields) >= 3 && fields[0] == "class" {
+			class = fields[2]
+			continue
+		}
+		match := sentBytes.FindStringSubmatch(line)
+		if match == nil || !wanted[class] {
+			continue
+		}
+		sent, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		sum += sent
+		delete(wanted, class)
+	}
+	for classid := range wanted {
+		return 0, fmt.Errorf("no statistics of class %s", classid)
+	}
+	return sum, nil
+}
+
+// downloadClass returns the class carrying the download traffic of a container, pool
+// members have theirs on the pool ifb since ingress cannot be redirected twice
+func downloadClass(container *docker.Container) (string, string) {
+	if container.Pool != "" {
+		if dev, minor, ok := poolDownloadClass(container.ID, container.Veth); ok {
+			return dev, fmt.Sprintf("1:%x", minor)
+		}
+	}
+	return container.Ifb, "1:1"
+}
+
+// trafficClasses are the classes of a device carrying a direction of the traffic of a container
+type trafficClasses struct {
+	dev     string
+	classes []string
+}
+
+// trafficDelta returns the bytes uploaded and downloaded by the container since the last call made by consumer.
+// The traffic of topology peers goes through the region classes of the veth instead of 1:2 and is counted too.
+// Host network containers only have their upload shaped, their download is always 0.
+func trafficDelta(consumer string, container *docker.Container) ([2]uint64, error) {
+	var delta [2]uint64
+	downDev, downClass := downloadClass(container)
+	directions := []trafficClasses{
+		{container.Veth, append([]string{"1:2"}, regionClasses(container.Region)...)},
+		{downDev, []string{downClass}},
+	}
+	if container.Cgroup != "" {
+		dev, class, ok := uplinkClass(container.ID)
+		if !ok {
+			return delta, fmt.Errorf("container %s is not shaped on the uplink", container.Name)
+		}
+		directions = []trafficClasses{{dev, []string{class}}}
+	}
+	for i, direction := range directions {
+		var sent uint64
+		err := inNetns(container, func() error {
+			var err error
+			sent, err = classBytes(direction.dev, direction.classes...)
+			return err
+		})
+		if err != nil {
+			return delta, err
+		}
+		key := fmt.Sprintf("%s/%s/%d", memberKey(container.ID, container.Veth), consumer, i)
+		counters.Lock()
+		// Counters start over when the class is created again
+		delta[i] = sent
+		if last := counters.m[key]; sent >= last {
+			delta[i] = sent - last
+		}
+		counters.m[key] = sent
+		counters.Unlock()
+	}
+	return delta, nil
+}
+
+// forgetCounters drops the counters of the container classes
+func forgetCounters(id string) {
+	counters.Lock()
+	defer counters.Unlock()
+	for key := range counters.m {
+		if strings.HasPrefix(key, id+"/") {
+			delete(counters.m, key)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package tc
+
+import "testing"
+
+const classShow = `class htb 1:1 root rate 100Mbit ceil 100Mbit burst 1600b cburst 1600b 
+ Sent 5000 bytes 40 pkt (dropped 0, overlimits 0 requeues 0) 
+ backlog 0b 0p requeues 0
+ lended: 0 borrowed: 0 giants: 0
+ tokens: 2000 ctokens: 2000
+
+class htb 1:10 parent 1:1 leaf 10: prio 0 rate 1Mbit ceil 1Mbit burst 1600b cburst 1600b 
+ Sent 1200 bytes 10 pkt (dropped 0, overlimits 0 requeues 0) 
+ backlog 0b 0p requeues 0
+ lended: 10 borrowed: 0 giants: 0
+ tokens: 200000 ctokens: 200000
+
+class htb 1:2 parent 1:1 leaf 20: prio 0 rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b 
+ Sent 3400 bytes 30 pkt (dropped 0, overlimits 0 requeues 0) 
+ backlog 0b 0p requeues 0
+ lended: 30 borrowed: 0 giants: 0
+ tokens: 20000 ctokens: 20000
+`
+
+func TestParseClassBytes(t *testing.T) {
+	tests := []struct {
+		classids []string
+		want     uint64
+		ok       bool
+	}{
+		{[]string{"1:2"}, 3400, true},
+		{[]string{"1:10"}, 1200, true},
+		{[]string{"1:2", "1:10"}, 4600, true},
+		{nil, 0, true},
+		{[]string{"1:2", "1:20"}, 0, false},
+		{[]string{"1:a"}, 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseClassBytes([]byte(classShow), tt.classids...)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseClassBytes(%v) error = %v, want ok %t", tt.classids, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseClassBytes(%v) = %d, want %d", tt.classids, got, tt.want)
+		}
+	}
+}
@@ -29,6 +29,6 @@ func setupSetting() error {
 	if err != nil {
 		return err
 	}
-	global.Ctx = context.Background()
+	global.Ctx, global.Cancel = context.WithCancel(context.Background())
 	return nil
 }
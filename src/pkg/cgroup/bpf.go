@@ -0,0 +1,256 @@
+package cgroup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// bpf commands, program and attach types and flags from linux/bpf.h
+const (
+	bpfProgLoad       = 5
+	bpfProgAttach     = 8
+	bpfProgDetach     = 9
+	bpfProgGetFdByID  = 13
+	bpfObjGetInfoByFd = 15
+	bpfProgQuery      = 16
+
+	bpfProgTypeCgroupSkb = 8
+	bpfCgroupInetEgress  = 1
+	bpfFAllowMulti       = 2
+)
+
+const (
+	// rlimitMemlock is RLIMIT_MEMLOCK of the architectures supported
+	rlimitMemlock = 8
+	// Offsets of priority and ifindex in struct __sk_buff
+	skbPriorityOffset = 32
+	skbIfindexOffset  = 40
+	// classifierName tells the programs of Classify apart from the ones attached by others
+	classifierName = "tc_docker"
+	// maxAttachedPrograms bounds the programs listed when querying a cgroup
+	maxAttachedPrograms = 64
+)
+
+// insn is a bpf instruction, dst and src registers share regs, src in the high nibble
+type insn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+type progLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              uint64
+	license            uint64
+	logLevel           uint32
+	logSize            uint32
+	logBuf             uint64
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [16]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+}
+
+type attachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+type queryAttr struct {
+	targetFd    uint32
+	attachType  uint32
+	queryFlags  uint32
+	attachFlags uint32
+	progIds     uint64
+	progCnt     uint32
+	_           uint32
+}
+
+type getFdAttr struct {
+	id        uint32
+	nextID    uint32
+	openFlags uint32
+}
+
+type infoAttr struct {
+	bpfFd   uint32
+	infoLen uint32
+	info    uint64
+}
+
+// progInfo is the head of struct bpf_prog_info, up to the program name
+type progInfo struct {
+	typ       uint32
+	id        uint32
+	tag       [8]byte
+	jitedLen  uint32
+	xlatedLen uint32
+	jited     uint64
+	xlated    uint64
+	loadTime  uint64
+	uid       uint32
+	nrMapIDs  uint32
+	mapIDs    uint64
+	name      [16]byte
+}
+
+var memlock sync.Once
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := syscall.Syscall(sysBPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+// Classify attaches to the cgroup v2 path a program setting the priority of the packets the cgroup
+// sends through the interface ifindex to classid, HTB takes a priority naming one of its classes as
+// the class of the packet. Programs of an earlier Classify on the cgroup are detached, the programs
+// go away with the cgroup so nothing is left behind when the container dies.
+func Classify(path string, ifindex int, classid uint32) error {
+	prog, err := loadClassifier(ifindex, classid)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(prog)
+
+	cg, err := os.Open(filepath.Join(Root, path))
+	if err != nil {
+		return fmt.Errorf("open cgroup %s: %v", path, err)
+	}
+	defer cg.Close()
+	// The new program is attached before the old ones are detached so no packet goes unclassified
+	stale, err := classifiers(int(cg.Fd()))
+	if err != nil {
+		return fmt.Errorf("query programs of cgroup %s: %v", path, err)
+	}
+	attr := attachAttr{targetFd: uint32(cg.Fd()), attachBpfFd: uint32(prog), attachType: bpfCgroupInetEgress, attachFlags: bpfFAllowMulti}
+	if _, err := bpf(bpfProgAttach, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return fmt.Errorf("attach classifier to cgroup %s: %v", path, err)
+	}
+	return detach(int(cg.Fd()), stale)
+}
+
+// Unclassify detaches the programs of Classify from the cgroup v2 path, it is fine when the cgroup is gone
+func Unclassify(path string) error {
+	cg, err := os.Open(filepath.Join(Root, path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open cgroup %s: %v", path, err)
+	}
+	defer cg.Close()
+	progs, err := classifiers(int(cg.Fd()))
+	if err != nil {
+		return fmt.Errorf("query programs of cgroup %s: %v", path, err)
+	}
+	return detach(int(cg.Fd()), progs)
+}
+
+// ProbeClassify loads the program of Classify without attaching it, it fails when the kernel
+// or the privileges of the daemon don't allow it
+func ProbeClassify() error {
+	prog, err := loadClassifier(1, 0x10010)
+	if err != nil {
+		return err
+	}
+	return syscall.Close(prog)
+}
+
+// loadClassifier loads the program of Classify, which runs
+//
+//	if (skb->ifindex == ifindex)
+//		skb->priority = classid;
+//	return 1;
+func loadClassifier(ifindex int, classid uint32) (int, error) {
+	memlock.Do(func() {
+		// Kernels before 5.11 charge programs to the locked memory of the process
+		limit := syscall.Rlimit{Cur: ^uint64(0), Max: ^uint64(0)}
+		syscall.Setrlimit(rlimitMemlock, &limit)
+	})
+	insns := []insn{
+		{code: 0x61, regs: 0x12, off: skbIfindexOffset},       // r2 = *(u32 *)(r1 + ifindex)
+		{code: 0x55, regs: 0x02, off: 2, imm: int32(ifindex)}, // if r2 != ifindex skip 2
+		{code: 0xb7, regs: 0x03, imm: int32(classid)},         // r3 = classid
+		{code: 0x63, regs: 0x31, off: skbPriorityOffset},      // *(u32 *)(r1 + priority) = r3
+		{code: 0xb7, regs: 0x00, imm: 1},                      // r0 = 1, let the packet through
+		{code: 0x95},                                          // exit
+	}
+	license := []byte("GPL\x00")
+	log := make([]byte, 4096)
+	attr := progLoadAttr{
+		progType:           bpfProgTypeCgroupSkb,
+		insnCnt:            uint32(len(insns)),
+		insns:              uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:            uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel:           1,
+		logSize:            uint32(len(log)),
+		logBuf:             uint64(uintptr(unsafe.Pointer(&log[0]))),
+		expectedAttachType: bpfCgroupInetEgress,
+	}
+	copy(attr.progName[:], classifierName)
+	fd, err := bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(log)
+	if err != nil {
+		return 0, fmt.Errorf("load cgroup classifier: %v, verifier: %s", err, bytes.TrimRight(log, "\x00"))
+	}
+	return fd, nil
+}
+
+// classifiers returns the programs of Classify attached to the cgroup, opened
+func classifiers(cg int) ([]int, error) {
+	ids := make([]uint32, maxAttachedPrograms)
+	attr := queryAttr{targetFd: uint32(cg), attachType: bpfCgroupInetEgress, progIds: uint64(uintptr(unsafe.Pointer(&ids[0]))), progCnt: uint32(len(ids))}
+	_, err := bpf(bpfProgQuery, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(ids)
+	if err != nil {
+		return nil, err
+	}
+	var progs []int
+	for _, id := range ids[:attr.progCnt] {
+		get := getFdAttr{id: id}
+		fd, err := bpf(bpfProgGetFdByID, unsafe.Pointer(&get), unsafe.Sizeof(get))
+		if err != nil {
+			// Detached meanwhile
+			continue
+		}
+		var info progInfo
+		infoReq := infoAttr{bpfFd: uint32(fd), infoLen: uint32(unsafe.Sizeof(info)), info: uint64(uintptr(unsafe.Pointer(&info)))}
+		_, err = bpf(bpfObjGetInfoByFd, unsafe.Pointer(&infoReq), unsafe.Sizeof(infoReq))
+		runtime.KeepAlive(&info)
+		if err != nil || string(bytes.TrimRight(info.name[:], "\x00")) != classifierName {
+			syscall.Close(fd)
+			continue
+		}
+		progs = append(progs, fd)
+	}
+	return progs, nil
+}
+
+// detach detaches the programs from the cgroup and closes them
+func detach(cg int, progs []int) error {
+	var first error
+	for _, prog := range progs {
+		attr := attachAttr{targetFd: uint32(cg), attachBpfFd: uint32(prog), attachType: bpfCgroupInetEgress}
+		if _, err := bpf(bpfProgDetach, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil && first == nil {
+			first = fmt.Errorf("detach classifier: %v", err)
+		}
+		syscall.Close(prog)
+	}
+	return first
+}
@@ -0,0 +1,3 @@
+package cgroup
+
+const sysBPF = 280
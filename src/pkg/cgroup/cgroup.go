@@ -0,0 +1,61 @@
+// Package cgroup finds the cgroup of processes and sets the net_cls class of cgroup v1 hierarchies
+package cgroup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Root is where the cgroup hierarchies are mounted
+const Root = "/sys/fs/cgroup"
+
+// Unified tells whether the host runs cgroup v2 only
+func Unified() bool {
+	_, err := ioutil.ReadFile(filepath.Join(Root, "cgroup.controllers"))
+	return err == nil
+}
+
+// Path returns the cgroup of the process with the given pid, on cgroup v1 the one of its
+// net_cls hierarchy. The pid is seen from /proc, so it must be a pid of the host.
+func Path(pid int) (string, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	unified := Unified()
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		// Lines are hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if unified && fields[0] == "0" && fields[1] == "" {
+			return fields[2], nil
+		}
+		if !unified {
+			for _, controller := range strings.Split(fields[1], ",") {
+				if controller == "net_cls" {
+					return fields[2], nil
+				}
+			}
+		}
+	}
+	if unified {
+		return "", fmt.Errorf("process %d has no cgroup v2", pid)
+	}
+	return "", fmt.Errorf("process %d has no net_cls cgroup, is the net_cls controller mounted", pid)
+}
+
+// SetClassID sets the net_cls class of the cgroup v1 path, classid is major:minor packed as 0xMMMMmmmm
+func SetClassID(path string, classid uint32) error {
+	file := filepath.Join(Root, "net_cls", path, "net_cls.classid")
+	if err := ioutil.WriteFile(file, []byte(fmt.Sprintf("%d", classid)), 0644); err != nil {
+		return fmt.Errorf("set net_cls class of %s: %v", path, err)
+	}
+	return nil
+}
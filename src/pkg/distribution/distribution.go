@@ -0,0 +1,157 @@
+// Package distribution builds netem delay distribution tables from measured samples,
+// it is a port of iproute2's netem/maketable.c
+package distribution
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	// TableSize is the number of entries of a netem distribution table, TABLESIZE of maketable
+	TableSize = 16384 / 4
+	// tableFactor is NETEM_DIST_SCALE, the value of one standard deviation in the table
+	tableFactor = 8192
+
+	// The samples are counted in a histogram of distTableGranularity buckets per standard
+	// deviation, up to distTableDomain standard deviations away from the mean
+	distTableDomain      = 4
+	distTableGranularity = 50000
+	distTableSize        = distTableDomain * distTableGranularity * 2
+
+	minShort = math.MinInt16
+	maxShort = math.MaxInt16
+)
+
+// Table is a netem distribution table along with the statistics of the samples it was built from
+type Table struct {
+	Values []int16
+	Mean   float64
+	Stddev float64
+}
+
+// ReadSamples reads whitespace separated numbers from r
+func ReadSamples(r io.Reader) ([]float64, error) {
+	var samples []float64
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		v, err := strconv.ParseFloat(scanner.Text(), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample %q", scanner.Text())
+		}
+		samples = append(samples, v)
+	}
+	return samples, scanner.Err()
+}
+
+// Make builds the distribution table of samples, normalized by their mean and standard deviation
+func Make(samples []float64) (*Table, error) {
+	if len(samples) < 2 {
+		return nil, errors.New("at least two samples are required")
+	}
+	mean, stddev := stats(samples)
+	if stddev == 0 {
+		return nil, errors.New("samples have no variation")
+	}
+
+	dist := make([]int, distTableSize)
+	for _, x := range samples {
+		index := int(math.RoundToEven(((x-mean)/stddev + distTableDomain) * distTableGranularity))
+		if index < 0 {
+			index = 0
+		}
+		if index >= distTableSize {
+			index = distTableSize - 1
+		}
+		dist[index]++
+	}
+
+	// Replace the histogram by its cumulative distribution
+	total := 0
+	for i := range dist {
+		total += dist[i]
+		dist[i] = total
+	}
+
+	table := invert(dist, total)
+	interpolate(table)
+	return &Table{Values: table, Mean: mean, Stddev: stddev}, nil
+}
+
+// Write writes table in the format tc reads from its library directory
+func (t *Table) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# This is the distribution table for the experimental distribution.\n")
+	fmt.Fprintf(bw, "# mean: %g, stddev: %g\n", t.Mean, t.Stddev)
+	for i, v := range t.Values {
+		sep := byte(' ')
+		if i%8 == 7 {
+			sep = '\n'
+		}
+		fmt.Fprintf(bw, "%d%c", v, sep)
+	}
+	return bw.Flush()
+}
+
+func stats(samples []float64) (float64, float64) {
+	var sum, sumSquare float64
+	for _, x := range samples {
+		sum += x
+		sumSquare += x * x
+	}
+	n := float64(len(samples))
+	mean := sum / n
+	variance := (sumSquare - n*mean*mean) / (n - 1)
+	if variance < 0 {
+		variance = 0
+	}
+	return mean, math.Sqrt(variance)
+}
+
+// invert turns the cumulative distribution into a table of TableSize values indexed by probability
+func invert(cumulative []int, total int) []int16 {
+	inverse := make([]int16, TableSize)
+	for i := range inverse {
+		inverse[i] = minShort
+	}
+	for i, c := range cumulative {
+		index := int(math.RoundToEven(float64(c) / float64(total) * TableSize))
+		value := int(math.RoundToEven((float64(i)/distTableGranularity - distTableDomain) * tableFactor))
+		if value <= minShort {
+			value = minShort + 1
+		}
+		if value > maxShort {
+			value = maxShort
+		}
+		if index >= TableSize {
+			index = TableSize - 1
+		}
+		inverse[index] = int16(value)
+	}
+	return inverse
+}
+
+// interpolate fills the entries invert left empty with a linear interpolation of their neighbours
+func interpolate(table []int16) {
+	last, lastIndex := minShort, -1
+	for i := range table {
+		if table[i] != minShort {
+			last, lastIndex = int(table[i]), i
+			continue
+		}
+		j := i
+		for j < len(table) && table[j] == minShort {
+			j++
+		}
+		next, end := maxShort, len(table)
+		if j < len(table) {
+			next, end = int(table[j]), j
+		}
+		table[i] = int16(last + (i-lastIndex)*(next-last)/(end-lastIndex))
+	}
+}
@@ -0,0 +1,124 @@
+package distribution
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestReadSamples(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []float64
+		ok   bool
+	}{
+		{"1 2 3", []float64{1, 2, 3}, true},
+		{"1.5\n-2\t3e2\n", []float64{1.5, -2, 300}, true},
+		{"", nil, true},
+		{"1 two 3", nil, false},
+	}
+	for _, tt := range tests {
+		samples, err := ReadSamples(strings.NewReader(tt.in))
+		if (err == nil) != tt.ok {
+			t.Errorf("ReadSamples(%q) error = %v, want ok %t", tt.in, err, tt.ok)
+			continue
+		}
+		if len(samples) != len(tt.want) {
+			t.Errorf("ReadSamples(%q) = %v, want %v", tt.in, samples, tt.want)
+			continue
+		}
+		for i := range samples {
+			if samples[i] != tt.want[i] {
+				t.Errorf("ReadSamples(%q) = %v, want %v", tt.in, samples, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMake(t *testing.T) {
+	uniform := make([]float64, 1000)
+	for i := range uniform {
+		uniform[i] = float64(i)
+	}
+	tests := []struct {
+		name    string
+		samples []float64
+		mean    float64
+		stddev  float64
+		ok      bool
+	}{
+		{"uniform", uniform, 499.5, 288.8194, true},
+		{"two", []float64{10, 20}, 15, 7.0711, true},
+		{"one", []float64{10}, 0, 0, false},
+		{"constant", []float64{5, 5, 5}, 0, 0, false},
+	}
+	for _, tt := range tests {
+		table, err := Make(tt.samples)
+		if (err == nil) != tt.ok {
+			t.Errorf("Make(%s) error = %v, want ok %t", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if math.Abs(table.Mean-tt.mean) > 1e-3 || math.Abs(table.Stddev-tt.stddev) > 1e-3 {
+			t.Errorf("Make(%s) mean, stddev = %g, %g, want %g, %g", tt.name, table.Mean, table.Stddev, tt.mean, tt.stddev)
+		}
+		if len(table.Values) != TableSize {
+			t.Errorf("Make(%s) has %d values, want %d", tt.name, len(table.Values), TableSize)
+			continue
+		}
+		for i := 1; i < len(table.Values); i++ {
+			if table.Values[i] < table.Values[i-1] {
+				t.Errorf("Make(%s) values decrease at %d, %d after %d", tt.name, i, table.Values[i], table.Values[i-1])
+				break
+			}
+		}
+	}
+}
+
+func TestMakeUniformIsCentered(t *testing.T) {
+	samples := make([]float64, 10000)
+	for i := range samples {
+		samples[i] = float64(i)
+	}
+	table, err := Make(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A uniform distribution spans sqrt(3) standard deviations on each side of its mean
+	bound := math.Sqrt(3) * tableFactor
+	tests := []struct {
+		index int
+		want  float64
+	}{
+		{TableSize / 2, 0},
+		{TableSize / 4, -bound / 2},
+		{TableSize * 3 / 4, bound / 2},
+	}
+	for _, tt := range tests {
+		if got := float64(table.Values[tt.index]); math.Abs(got-tt.want) > tableFactor/100 {
+			t.Errorf("Make(uniform).Values[%d] = %g, want %g", tt.index, got, tt.want)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	table := &Table{Values: make([]int16, 16), Mean: 1.5, Stddev: 0.5}
+	for i := range table.Values {
+		table.Values[i] = int16(i - 8)
+	}
+	var b bytes.Buffer
+	if err := table.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "# This is the distribution table for the experimental distribution.\n" +
+		"# mean: 1.5, stddev: 0.5\n" +
+		"-8 -7 -6 -5 -4 -3 -2 -1\n" +
+		"0 1 2 3 4 5 6 7\n"
+	if b.String() != want {
+		t.Errorf("Write() = %q, want %q", b.String(), want)
+	}
+}
@@ -0,0 +1,174 @@
+// Package netlink lists the network interfaces and addresses of the current network namespace through rtnetlink
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// iflaInfoKind is the attribute of IFLA_LINKINFO holding the link type, e.g. veth or macvlan
+const iflaInfoKind = 1
+
+// Link is a network interface
+type Link struct {
+	Index int
+	Name  string
+	// Kind is the driver of the link, empty for physical devices
+	Kind string
+	MAC  string
+	MTU  int
+	// PeerIndex is the index of the link this one is attached to, for veths the peer
+	// in its own namespace, it is 0 when there is none
+	PeerIndex int
+	Up        bool
+	Loopback  bool
+}
+
+// Links returns every link of the current network namespace
+func Links() ([]Link, error) {
+	msgs, err := dump(syscall.RTM_GETLINK, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	var links []Link
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWLINK {
+			continue
+		}
+		link, err := parseLink(m)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// parseLink reads a RTM_NEWLINK or RTM_DELLINK message
+func parseLink(m syscall.NetlinkMessage) (Link, error) {
+	if len(m.Data) < syscall.SizeofIfInfomsg {
+		return Link{}, fmt.Errorf("short link message, %d bytes", len(m.Data))
+	}
+	info := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+	link := Link{
+		Index:    int(info.Index),
+		Up:       info.Flags&syscall.IFF_UP != 0,
+		Loopback: info.Flags&syscall.IFF_LOOPBACK != 0,
+	}
+	attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+	if err != nil {
+		return Link{}, fmt.Errorf("parse link attributes: %v", err)
+	}
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case syscall.IFLA_IFNAME:
+			link.Name = cString(a.Value)
+		case syscall.IFLA_ADDRESS:
+			link.MAC = net.HardwareAddr(a.Value).String()
+		case syscall.IFLA_MTU:
+			link.MTU = int(nativeUint32(a.Value))
+		case syscall.IFLA_LINK:
+			link.PeerIndex = int(nativeUint32(a.Value))
+		case syscall.IFLA_LINKINFO:
+			link.Kind = linkKind(a.Value)
+		}
+	}
+	return link, nil
+}
+
+// Addrs returns the IPv4 addresses of the current network namespace keyed by link index
+func Addrs() (map[int][]string, error) {
+	msgs, err := dump(syscall.RTM_GETADDR, syscall.AF_INET)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[int][]string)
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWADDR || len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		info := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, fmt.Errorf("parse address attributes: %v", err)
+		}
+		for _, a := range attrs {
+			if a.Attr.Type == syscall.IFA_LOCAL && len(a.Value) == net.IPv4len {
+				addrs[int(info.Index)] = append(addrs[int(info.Index)], net.IP(a.Value).String())
+			}
+		}
+	}
+	return addrs, nil
+}
+
+func dump(proto, family int) ([]syscall.NetlinkMessage, error) {
+	b, err := syscall.NetlinkRIB(proto, family)
+	if err != nil {
+		return nil, fmt.Errorf("netlink request %d: %v", proto, err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, fmt.Errorf("netlink answer %d: %v", proto, err)
+	}
+	return msgs, nil
+}
+
+// linkKind returns IFLA_INFO_KIND from the nested attributes of IFLA_LINKINFO
+func linkKind(b []byte) string {
+	return attrString(b, iflaInfoKind)
+}
+
+// attrString returns the string attribute typ of the attributes in b, empty when it is missing
+func attrString(b []byte, typ uint16) string {
+	for len(b) >= syscall.SizeofRtAttr {
+		length := int(nativeUint16(b[0:2]))
+		if length < syscall.SizeofRtAttr || length > len(b) {
+			return ""
+		}
+		if nativeUint16(b[2:4]) == typ {
+			return cString(b[syscall.SizeofRtAttr:length])
+		}
+		if align(length) >= len(b) {
+			break
+		}
+		b = b[align(length):]
+	}
+	return ""
+}
+
+func align(length int) int {
+	aligned := (length + syscall.RTA_ALIGNTO - 1) & ^(syscall.RTA_ALIGNTO - 1)
+	return aligned
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// Netlink attributes are in host byte order
+var nativeEndian = func() binary.ByteOrder {
+	i := uint16(1)
+	if *(*byte)(unsafe.Pointer(&i)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+func nativeUint16(b []byte) uint16 {
+	return nativeEndian.Uint16(b)
+}
+
+func nativeUint32(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return nativeEndian.Uint32(b)
+}
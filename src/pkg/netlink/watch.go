@@ -0,0 +1,105 @@
+package netlink
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// Multicast groups of rtnetlink, RTNLGRP_LINK and RTNLGRP_TC as bits of the bind address
+const (
+	rtmgrpLink = 0x1
+	rtmgrpTC   = 0x8
+)
+
+// tcmsgLen is the size of struct tcmsg heading qdisc messages, its interface index is at offset 4
+// and its parent at offset 12
+const tcmsgLen = 20
+
+// doneCheck is how often Watch checks whether it must stop
+const doneCheck = time.Second
+
+// tcaKind is the attribute of qdisc messages holding the qdisc kind
+const tcaKind = 1
+
+// Parents of the root and ingress qdiscs of a device
+const (
+	ParentRoot    = 0xffffffff
+	ParentIngress = 0xfffffff1
+)
+
+// Event is a change of a link or a qdisc of the current network namespace
+type Event struct {
+	// Type is the rtnetlink message, RTM_NEWLINK, RTM_DELLINK, RTM_NEWQDISC or RTM_DELQDISC
+	Type  uint16
+	Index int
+	// Name is only set for links, qdisc messages carry the interface index only
+	Name string
+	// Kind is the driver of a link or the kind of a qdisc
+	Kind   string
+	Parent uint32
+	// Lost tells the socket overflowed and events were dropped, the other fields are empty
+	Lost bool
+}
+
+// Watch calls f with every link and qdisc change of the current network namespace until done
+// is closed, it returns early only when reading the notifications fails
+func Watch(done <-chan struct{}, f func(Event)) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpLink | rtmgrpTC}); err != nil {
+		return fmt.Errorf("netlink bind: %v", err)
+	}
+	// Receiving times out so done is noticed while nothing changes
+	timeout := syscall.NsecToTimeval(int64(doneCheck))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		return fmt.Errorf("netlink receive timeout: %v", err)
+	}
+
+	b := make([]byte, 1<<16)
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		n, _, err := syscall.Recvfrom(fd, b, 0)
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		}
+		if err == syscall.ENOBUFS {
+			f(Event{Lost: true})
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("netlink receive: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(b[:n])
+		if err != nil {
+			return fmt.Errorf("netlink notification: %v", err)
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case syscall.RTM_NEWLINK, syscall.RTM_DELLINK:
+				link, err := parseLink(m)
+				if err != nil {
+					continue
+				}
+				f(Event{Type: m.Header.Type, Index: link.Index, Name: link.Name, Kind: link.Kind})
+			case syscall.RTM_NEWQDISC, syscall.RTM_DELQDISC:
+				if len(m.Data) < tcmsgLen {
+					continue
+				}
+				f(Event{
+					Type:   m.Header.Type,
+					Index:  int(int32(nativeUint32(m.Data[4:8]))),
+					Kind:   attrString(m.Data[tcmsgLen:], tcaKind),
+					Parent: nativeUint32(m.Data[12:16]),
+				})
+			}
+		}
+	}
+}
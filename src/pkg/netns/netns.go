@@ -0,0 +1,60 @@
+// Package netns runs functions inside the network namespace of a container
+package netns
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// Do runs f in a goroutine of its own locked to an OS thread that joined the network namespace at path,
+// e.g. the SandboxKey of a container, and waits for it. Sockets opened and commands started by f belong
+// to that namespace. The thread joins its original namespace afterwards, when it cannot it stays locked
+// so Go terminates it along with the goroutine and Do returns the error.
+func Do(path string, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- do(path, f)
+	}()
+	return <-done
+}
+
+func do(path string, f func() error) error {
+	runtime.LockOSThread()
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("open current netns: %v", err)
+	}
+	defer origin.Close()
+	target, err := os.Open(path)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("open netns %s: %v", path, err)
+	}
+	defer target.Close()
+
+	if err := setns(int(target.Fd())); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("setns %s: %v", path, err)
+	}
+	err = f()
+	if restoreErr := setns(int(origin.Fd())); restoreErr != nil {
+		// The thread is left locked, it never runs another goroutine
+		if err != nil {
+			return fmt.Errorf("%v, leave netns %s: %v", err, path, restoreErr)
+		}
+		return fmt.Errorf("leave netns %s: %v", path, restoreErr)
+	}
+	runtime.UnlockOSThread()
+	return err
+}
+
+func setns(fd int) error {
+	_, _, errno := syscall.RawSyscall(sysSetns, uintptr(fd), syscall.CLONE_NEWNET, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}